@@ -0,0 +1,824 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"slices"
+)
+
+// Binary format is
+//
+//	header: magic 'Q', type tag, version, flags
+//	type specific parameters and data
+//	CRC-32C of everything above, little endian
+//
+// Floats are stored as little endian IEEE 754 bits, integers are varints.
+// Centroids and exact values are stored sorted.
+// Compact flag changes values, weights and bins encoding, see binary_compact.go.
+
+type (
+	binReader struct {
+		b   []byte
+		i   int
+		err error
+
+		compact bool
+	}
+)
+
+const (
+	binMagic   = 'Q'
+	binVersion = 1
+
+	binHeaderLen = 4
+	binCRCLen    = 4
+
+	// binMaxAlloc limits the number of values allocated by parameters only,
+	// so malformed data can't make us allocate a lot.
+	binMaxAlloc = 1 << 20
+
+	binCompact = 1 << 0 // flag
+)
+
+// Type tags.
+const (
+	_ = iota
+	binTDigest
+	binDDLog
+	binKLL
+	binExact
+	binOSTree
+)
+
+// TDigest Invariant kinds.
+const (
+	_ = iota
+	binHighBias
+	binLowBias
+	binExtremesBias
+)
+
+var (
+	ErrChecksum             = errors.New("checksum mismatch")
+	ErrUnsupportedVersion   = errors.New("unsupported format version")
+	ErrUnsupportedInvariant = errors.New("unsupported invariant")
+)
+
+var binCRC = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	_ Marshaler = (*TDigest)(nil)
+	_ Marshaler = (*DDLog)(nil)
+	_ Marshaler = (*KLL)(nil)
+	_ Marshaler = (*Exact)(nil)
+	_ Marshaler = (*OSTree)(nil)
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Centroids are sorted in place.
+func (s *TDigest) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary appends binary encoded s to b.
+// Only HighBias, LowBias and ExtremesBias invariants are supported.
+func (s *TDigest) AppendBinary(b []byte) ([]byte, error) {
+	return s.appendBinary(b, 0)
+}
+
+func (s *TDigest) appendBinary(b []byte, flags byte) (_ []byte, err error) {
+	var kind byte
+	var eps float32
+
+	switch inv := s.Invariant.(type) {
+	case HighBias:
+		kind, eps = binHighBias, float32(inv)
+	case LowBias:
+		kind, eps = binLowBias, float32(inv)
+	case ExtremesBias:
+		kind, eps = binExtremesBias, float32(inv)
+	default:
+		return b, ErrUnsupportedInvariant
+	}
+
+	if !s.sorted {
+		s.sort()
+	}
+
+	st := len(b)
+	b = binAppendHeader(b, binTDigest, flags)
+
+	b = append(b, kind)
+	b = binAppendFloat32(b, eps)
+	b = binAppendFloat32(b, s.Decay)
+	b = binary.AppendUvarint(b, uint64(s.size))
+	b = binary.AppendUvarint(b, uint64(s.i))
+
+	b = binAppendValues(b, s.v[:s.i], flags)
+	b = binAppendWeights(b, s.w[:s.i], flags)
+
+	return binAppendCRC(b, st), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// s is replaced by the decoded sketch.
+func (s *TDigest) UnmarshalBinary(p []byte) error {
+	r, err := binOpen(p, binTDigest)
+	if err != nil {
+		return err
+	}
+
+	kind := r.byte()
+	eps := r.float32()
+	decay := r.float32()
+	size := r.len(binMaxAlloc)
+	n := r.len(size)
+
+	if r.err != nil {
+		return r.err
+	}
+
+	var inv Invariant
+
+	switch kind {
+	case binHighBias:
+		inv = HighBias(eps)
+	case binLowBias:
+		inv = LowBias(eps)
+	case binExtremesBias:
+		inv = ExtremesBias(eps)
+	default:
+		return ErrUnsupportedInvariant
+	}
+
+	if size == 0 || size%2 != 0 || n > r.items(12) {
+		return ErrMalformed
+	}
+
+	x := NewTD(inv, size)
+	x.Decay = decay
+
+	r.values(x.v[:n])
+	r.weights(x.w[:n])
+
+	x.i = n
+	x.sorted = slices.IsSorted(x.v[:n])
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	*s = *x
+
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s *DDLog) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary appends binary encoded s to b.
+// Bins, stats and MaxBins and Collapse settings are encoded.
+func (s *DDLog) AppendBinary(b []byte) ([]byte, error) {
+	return s.appendBinary(b, 0)
+}
+
+func (s *DDLog) appendBinary(b []byte, flags byte) (_ []byte, err error) {
+	gamma, offset, interp, err := ddMappingParams(s.m)
+	if err != nil {
+		return b, err
+	}
+
+	st := len(b)
+	b = binAppendHeader(b, binDDLog, flags)
+
+	b = append(b, byte(interp))
+	b = binAppendFloat64(b, gamma)
+	b = binAppendFloat64(b, offset)
+	b = append(b, byte(s.pos.kind()))
+	b = binary.AppendUvarint(b, uint64(max(s.MaxBins, 0)))
+	b = append(b, byte(s.Collapse))
+
+	b = binAppendFloat64(b, s.zeros)
+	b = binAppendFloat64(b, s.min)
+	b = binAppendFloat64(b, s.max)
+	b = binAppendFloat64(b, s.sum)
+
+	b = binAppendStore(b, s.pos, flags)
+	b = binAppendStore(b, s.neg, flags)
+
+	return binAppendCRC(b, st), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// s data, mapping, store kind, MaxBins and Collapse are replaced,
+// other settings are preserved.
+func (s *DDLog) UnmarshalBinary(p []byte) error {
+	r, err := binOpen(p, binDDLog)
+	if err != nil {
+		return err
+	}
+
+	interp := r.byte()
+	gamma := r.float64()
+	offset := r.float64()
+	kind := DDStore(r.byte())
+	maxBins := r.len(math.MaxInt32)
+	collapse := DDCollapse(r.byte())
+
+	if r.err != nil {
+		return r.err
+	}
+
+	m, err := ddMapping(gamma, offset, uint64(interp))
+	if err != nil {
+		return err
+	}
+
+	if kind&ddKindMask > DDSparse || kind&ddCountsMask > DDUint64 || kind&^(ddKindMask|ddCountsMask) != 0 ||
+		collapse > CollapseHighest {
+		return ErrMalformed
+	}
+
+	x := NewDDLogMapping(m, kind)
+	x.MaxBins = maxBins
+	x.Collapse = collapse
+	x.ShrinkBins = s.ShrinkBins
+	x.Interpolate = s.Interpolate
+
+	x.zeros = r.float64()
+	x.min = r.float64()
+	x.max = r.float64()
+	x.sum = r.float64()
+
+	if r.err == nil && (!binIsCount(x.zeros) || math.IsNaN(x.min) || math.IsNaN(x.max) || math.IsNaN(x.sum)) {
+		return ErrMalformed
+	}
+
+	err = binDecodeStore(x.pos, &r)
+	if err != nil {
+		return err
+	}
+
+	err = binDecodeStore(x.neg, &r)
+	if err != nil {
+		return err
+	}
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	*s = *x
+
+	return nil
+}
+
+// binAppendStore encodes dense stores as contiguous counts from the lowest key
+// and sparse stores as key/count pairs.
+func binAppendStore(b []byte, st ddstore, flags byte) []byte {
+	ckey, collapsed := st.collapsedKey()
+
+	if collapsed {
+		b = append(b, 1)
+		b = binary.AppendVarint(b, int64(ckey))
+	} else {
+		b = append(b, 0)
+	}
+
+	if flags&binCompact != 0 {
+		return binAppendStoreCompact(b, st)
+	}
+
+	lo, hi, ok := st.bounds()
+
+	if st.kind()&ddKindMask == DDSparse {
+		n := 0
+		st.each(func(int, float64) { n++ })
+
+		b = binary.AppendUvarint(b, uint64(n))
+
+		st.each(func(key int, w float64) {
+			b = binary.AppendVarint(b, int64(key))
+			b = binAppendFloat64(b, w)
+		})
+
+		return b
+	}
+
+	if !ok {
+		b = binary.AppendVarint(b, 0)
+		b = binary.AppendUvarint(b, 0)
+
+		return b
+	}
+
+	b = binary.AppendVarint(b, int64(lo))
+	b = binary.AppendUvarint(b, uint64(hi-lo+1))
+
+	next := lo
+
+	st.each(func(key int, w float64) {
+		for ; next < key; next++ {
+			b = binAppendFloat64(b, 0)
+		}
+
+		b = binAppendFloat64(b, w)
+		next++
+	})
+
+	return b
+}
+
+func binDecodeStore(st ddstore, r *binReader) error {
+	collapsed := r.byte()
+	ckey := 0
+
+	if collapsed == 1 {
+		ckey = r.int()
+	}
+
+	switch {
+	case r.compact:
+		binDecodeStoreCompact(st, r)
+	case st.kind()&ddKindMask == DDSparse:
+		n := r.len(r.left() / 9)
+
+		for range n {
+			key := r.int()
+			w := r.float64()
+
+			if r.err == nil && (w == 0 || !binIsCount(w)) {
+				return ErrMalformed
+			}
+
+			if r.err == nil {
+				st.add(key, w, 0)
+			}
+		}
+	default:
+		lo := r.int()
+		n := r.len(r.left() / 8)
+
+		if r.err == nil && n != 0 {
+			st.reserve(lo, lo+n-1, 0)
+		}
+
+		for i := range n {
+			w := r.float64()
+
+			if r.err == nil && !binIsCount(w) {
+				return ErrMalformed
+			}
+
+			if r.err == nil && w != 0 {
+				st.add(lo+i, w, 0)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	switch collapsed {
+	case 0:
+	case 1:
+		st.markCollapsed(ckey)
+	default:
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Levels are sorted in place.
+func (s *KLL) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary appends binary encoded s to b.
+func (s *KLL) AppendBinary(b []byte) ([]byte, error) {
+	return s.appendBinary(b, 0)
+}
+
+func (s *KLL) appendBinary(b []byte, flags byte) ([]byte, error) {
+	st := len(b)
+	b = binAppendHeader(b, binKLL, flags)
+
+	b = binary.AppendUvarint(b, uint64(s.width))
+	b = binary.AppendUvarint(b, uint64(s.depth))
+	b = binAppendFloat64(b, s.n)
+
+	for l := range s.depth {
+		st, end := s.startEnd(l)
+
+		if !s.s[l] {
+			s.sort(st, end)
+			s.s[l] = true
+		}
+
+		b = binary.AppendUvarint(b, uint64(end-st))
+		b = binAppendValues(b, s.v[st:end], flags)
+	}
+
+	return binAppendCRC(b, st), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// s is replaced by the decoded sketch.
+func (s *KLL) UnmarshalBinary(p []byte) error {
+	r, err := binOpen(p, binKLL)
+	if err != nil {
+		return err
+	}
+
+	width := r.len(binMaxAlloc)
+	depth := r.len(binMaxAlloc)
+	n := r.float64()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if width == 0 || width%2 != 0 || depth == 0 || width*depth > binMaxAlloc || !(n >= 0) {
+		return ErrMalformed
+	}
+
+	x := NewKLL(width, depth)
+	x.n = n
+
+	for l := range depth {
+		x.l[l] = r.len(width)
+
+		st, end := x.startEnd(l)
+
+		r.values(x.v[st:end])
+
+		x.s[l] = slices.IsSorted(x.v[st:end])
+	}
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	*s = *x
+
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Values are sorted in place.
+func (s *Exact) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary appends binary encoded s to b.
+func (s *Exact) AppendBinary(b []byte) ([]byte, error) {
+	return s.appendBinary(b, 0)
+}
+
+func (s *Exact) appendBinary(b []byte, flags byte) ([]byte, error) {
+	if !s.sorted {
+		s.sort()
+	}
+
+	st := len(b)
+	b = binAppendHeader(b, binExact, flags)
+
+	b = binary.AppendUvarint(b, uint64(s.Method))
+	b = binary.AppendUvarint(b, uint64(len(s.v)))
+
+	if s.w == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+	}
+
+	b = binAppendValues(b, s.v, flags)
+	b = binAppendWeights(b, s.w, flags)
+
+	return binAppendCRC(b, st), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// s is replaced by the decoded values.
+func (s *Exact) UnmarshalBinary(p []byte) error {
+	r, err := binOpen(p, binExact)
+	if err != nil {
+		return err
+	}
+
+	method := ExactMethod(r.len(int(ExactNormalUnbiased)))
+	n := r.len(r.items(8))
+	weighted := r.byte()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if weighted > 1 {
+		return ErrMalformed
+	}
+
+	x := &Exact{
+		v:      make([]float64, n),
+		Method: method,
+	}
+
+	r.values(x.v)
+
+	if weighted == 1 {
+		if n > r.items(4) {
+			return ErrMalformed
+		}
+
+		x.w = make([]float32, n)
+		r.weights(x.w)
+
+		for _, w := range x.w {
+			if !(w > 0) && r.err == nil {
+				r.err = ErrMalformed // Exact never keeps non-positive weights
+			}
+
+			x.total += float64(w)
+		}
+	} else {
+		x.total = float64(n)
+	}
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	x.sorted = slices.IsSorted(x.v)
+
+	*s = *x
+
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s *OSTree) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary appends binary encoded s to b.
+func (s *OSTree) AppendBinary(b []byte) ([]byte, error) {
+	return s.appendBinary(b, 0)
+}
+
+func (s *OSTree) appendBinary(b []byte, flags byte) ([]byte, error) {
+	st := len(b)
+	b = binAppendHeader(b, binOSTree, flags)
+
+	vs := make([]float64, int(s.Count()))
+
+	for k := range vs {
+		vs[k] = s.Select(k)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(vs)))
+	b = binAppendValues(b, vs, flags)
+
+	return binAppendCRC(b, st), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// s values are replaced by the decoded ones.
+func (s *OSTree) UnmarshalBinary(p []byte) error {
+	r, err := binOpen(p, binOSTree)
+	if err != nil {
+		return err
+	}
+
+	vs := make([]float64, r.len(r.items(8)))
+	r.values(vs)
+
+	x := &OSTree{}
+
+	for _, v := range vs {
+		x.Insert(v)
+	}
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	*s = *x
+
+	return nil
+}
+
+func binAppendHeader(b []byte, tag, flags byte) []byte {
+	return append(b, binMagic, tag, binVersion, flags)
+}
+
+func binAppendCRC(b []byte, st int) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b[st:], binCRC))
+}
+
+func binAppendFloat64(b []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func binAppendValues(b []byte, vs []float64, flags byte) []byte {
+	if flags&binCompact != 0 {
+		return binAppendGorilla(b, vs)
+	}
+
+	for _, v := range vs {
+		b = binAppendFloat64(b, v)
+	}
+
+	return b
+}
+
+func binAppendWeights(b []byte, ws []float32, flags byte) []byte {
+	if flags&binCompact != 0 {
+		return binAppendCompactWeights(b, ws)
+	}
+
+	for _, w := range ws {
+		b = binAppendFloat32(b, w)
+	}
+
+	return b
+}
+
+func binAppendFloat32(b []byte, v float32) []byte {
+	return binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+}
+
+// binOpen checks p header and checksum and returns the reader of the data in between.
+func binOpen(p []byte, tag byte) (r binReader, err error) {
+	if len(p) < binHeaderLen+binCRCLen || p[0] != binMagic {
+		return r, ErrMalformed
+	}
+
+	end := len(p) - binCRCLen
+
+	if crc32.Checksum(p[:end], binCRC) != binary.LittleEndian.Uint32(p[end:]) {
+		return r, ErrChecksum
+	}
+
+	if p[1] != tag {
+		return r, ErrTypeMismatch
+	}
+
+	if p[2] != binVersion {
+		return r, ErrUnsupportedVersion
+	}
+
+	if p[3]&^binCompact != 0 {
+		return r, ErrMalformed
+	}
+
+	return binReader{b: p[:end], i: binHeaderLen, compact: p[3]&binCompact != 0}, nil
+}
+
+// finish reports an error if data was malformed or not read completely.
+func (r *binReader) finish() error {
+	if r.err == nil && r.i != len(r.b) {
+		r.err = ErrMalformed
+	}
+
+	return r.err
+}
+
+func (r *binReader) left() int {
+	return len(r.b) - r.i
+}
+
+// items returns the maximum number of size bytes values encoded in the rest of data.
+func (r *binReader) items(size int) int {
+	if r.compact {
+		return r.left() * 8 // a bit per value at least
+	}
+
+	return r.left() / size
+}
+
+func (r *binReader) values(dst []float64) {
+	if r.compact {
+		r.gorilla(dst)
+	} else {
+		for i := range dst {
+			dst[i] = r.float64()
+		}
+	}
+
+	for _, v := range dst {
+		if math.IsNaN(v) {
+			r.err = ErrMalformed
+		}
+	}
+}
+
+// binIsCount reports whether w is a valid bin or zeros count.
+func binIsCount(w float64) bool {
+	return w >= 0 && w <= math.MaxFloat64
+}
+
+// weights reads weights rejecting negative and NaN ones.
+// Zero is valid, TDigest centroids get it from AdjustWeights(0).
+func (r *binReader) weights(dst []float32) {
+	if r.compact {
+		r.compactWeights(dst)
+	} else {
+		for i := range dst {
+			dst[i] = r.float32()
+		}
+	}
+
+	for _, w := range dst {
+		if !(w >= 0) {
+			r.err = ErrMalformed
+		}
+	}
+}
+
+func (r *binReader) byte() byte {
+	if r.err != nil || r.left() < 1 {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	r.i++
+
+	return r.b[r.i-1]
+}
+
+// len reads non-negative integer not greater than limit.
+func (r *binReader) len(limit int) int {
+	x := r.uvarint()
+	if x > uint64(limit) {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	return int(x)
+}
+
+func (r *binReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	x, n := binary.Uvarint(r.b[r.i:])
+	if n <= 0 {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	r.i += n
+
+	return x
+}
+
+func (r *binReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+
+	x, n := binary.Varint(r.b[r.i:])
+	if n <= 0 || x > math.MaxInt32 || x < math.MinInt32 {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	r.i += n
+
+	return int(x)
+}
+
+func (r *binReader) float64() float64 {
+	if r.err != nil || r.left() < 8 {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	r.i += 8
+
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.i-8:]))
+}
+
+func (r *binReader) float32() float32 {
+	if r.err != nil || r.left() < 4 {
+		r.err = ErrMalformed
+		return 0
+	}
+
+	r.i += 4
+
+	return math.Float32frombits(binary.LittleEndian.Uint32(r.b[r.i-4:]))
+}
@@ -0,0 +1,391 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// Compact encoding.
+//
+// Values are Gorilla-style XOR encoded bit stream:
+// each value is XORed with the previous one, zero XOR is a single 0 bit,
+// otherwise it's 1 bit, then 0 bit and the meaningful bits if they fit the previous window,
+// or 1 bit, 6 bits of leading zeros, 6 bits of meaningful bits length minus one and the bits.
+// The stream is padded to a byte.
+// Sorted values are close to each other, so they share sign, exponent and high significand bits.
+//
+// Weights and bin counts are a byte of kind followed by varints if all of them are integers,
+// or raw floats otherwise.
+//
+// Bins are runs of contiguous non-empty bins:
+// number of runs, counts kind, the first key,
+// then for each run the number of empty bins before it minus one (except the first one),
+// the run length and the counts.
+
+type (
+	binBitWriter struct {
+		b   []byte
+		acc uint64
+		n   uint
+	}
+
+	binBitReader struct {
+		r   *binReader
+		acc uint64
+		n   uint
+	}
+)
+
+const (
+	binFloats = iota
+	binInts
+)
+
+// MarshalCompact encodes s the same way as MarshalBinary does, but in a compact form.
+// UnmarshalBinary decodes both forms.
+func (s *TDigest) MarshalCompact() ([]byte, error) {
+	return s.appendBinary(nil, binCompact)
+}
+
+// AppendCompact appends compact binary encoded s to b.
+func (s *TDigest) AppendCompact(b []byte) ([]byte, error) {
+	return s.appendBinary(b, binCompact)
+}
+
+// MarshalCompact encodes s the same way as MarshalBinary does, but in a compact form.
+// UnmarshalBinary decodes both forms.
+func (s *DDLog) MarshalCompact() ([]byte, error) {
+	return s.appendBinary(nil, binCompact)
+}
+
+// AppendCompact appends compact binary encoded s to b.
+func (s *DDLog) AppendCompact(b []byte) ([]byte, error) {
+	return s.appendBinary(b, binCompact)
+}
+
+// MarshalCompact encodes s the same way as MarshalBinary does, but in a compact form.
+// UnmarshalBinary decodes both forms.
+func (s *KLL) MarshalCompact() ([]byte, error) {
+	return s.appendBinary(nil, binCompact)
+}
+
+// AppendCompact appends compact binary encoded s to b.
+func (s *KLL) AppendCompact(b []byte) ([]byte, error) {
+	return s.appendBinary(b, binCompact)
+}
+
+// MarshalCompact encodes s the same way as MarshalBinary does, but in a compact form.
+// UnmarshalBinary decodes both forms.
+func (s *Exact) MarshalCompact() ([]byte, error) {
+	return s.appendBinary(nil, binCompact)
+}
+
+// AppendCompact appends compact binary encoded s to b.
+func (s *Exact) AppendCompact(b []byte) ([]byte, error) {
+	return s.appendBinary(b, binCompact)
+}
+
+// MarshalCompact encodes s the same way as MarshalBinary does, but in a compact form.
+// UnmarshalBinary decodes both forms.
+func (s *OSTree) MarshalCompact() ([]byte, error) {
+	return s.appendBinary(nil, binCompact)
+}
+
+// AppendCompact appends compact binary encoded s to b.
+func (s *OSTree) AppendCompact(b []byte) ([]byte, error) {
+	return s.appendBinary(b, binCompact)
+}
+
+func binAppendGorilla(b []byte, vs []float64) []byte {
+	w := binBitWriter{b: b}
+
+	var prev uint64
+	var lead, size uint
+	var window bool
+
+	for _, v := range vs {
+		x := math.Float64bits(v)
+		xor := x ^ prev
+		prev = x
+
+		if xor == 0 {
+			w.write(0, 1)
+			continue
+		}
+
+		l := uint(bits.LeadingZeros64(xor))
+		t := uint(bits.TrailingZeros64(xor))
+
+		if window && l >= lead && t >= 64-lead-size {
+			w.write(0b10, 2)
+			w.write(xor>>(64-lead-size), size)
+
+			continue
+		}
+
+		lead, size, window = l, 64-l-t, true
+
+		w.write(0b11, 2)
+		w.write(uint64(lead), 6)
+		w.write(uint64(size-1), 6)
+		w.write(xor>>t, size)
+	}
+
+	return w.flush()
+}
+
+func (r *binReader) gorilla(dst []float64) {
+	br := binBitReader{r: r}
+
+	var prev uint64
+	var lead, size uint
+	var window bool
+
+	for i := range dst {
+		switch {
+		case br.read(1) == 0:
+		case br.read(1) == 0:
+			if !window {
+				r.err = ErrMalformed
+				return
+			}
+
+			prev ^= br.read(size) << (64 - lead - size)
+		default:
+			lead = uint(br.read(6))
+			size = uint(br.read(6)) + 1
+			window = true
+
+			if lead+size > 64 {
+				r.err = ErrMalformed
+				return
+			}
+
+			prev ^= br.read(size) << (64 - lead - size)
+		}
+
+		if r.err != nil {
+			return
+		}
+
+		dst[i] = math.Float64frombits(prev)
+	}
+}
+
+func binAppendCompactWeights(b []byte, ws []float32) []byte {
+	ints := true
+
+	for _, w := range ws {
+		ints = ints && binIsInt(float64(w))
+	}
+
+	if !ints {
+		b = append(b, binFloats)
+
+		for _, w := range ws {
+			b = binAppendFloat32(b, w)
+		}
+
+		return b
+	}
+
+	b = append(b, binInts)
+
+	for _, w := range ws {
+		b = binary.AppendUvarint(b, uint64(w))
+	}
+
+	return b
+}
+
+func (r *binReader) compactWeights(dst []float32) {
+	switch r.byte() {
+	case binFloats:
+		for i := range dst {
+			dst[i] = r.float32()
+		}
+	case binInts:
+		for i := range dst {
+			dst[i] = float32(r.uvarint())
+		}
+	default:
+		r.err = ErrMalformed
+	}
+}
+
+// binAppendStoreCompact encodes non-empty bins as contiguous runs.
+func binAppendStoreCompact(b []byte, st ddstore) []byte {
+	runs := 0
+	next := 0
+	ints := true
+
+	st.each(func(key int, w float64) {
+		if runs == 0 || key != next {
+			runs++
+		}
+
+		next = key + 1
+		ints = ints && binIsInt(w)
+	})
+
+	b = binary.AppendUvarint(b, uint64(runs))
+	if runs == 0 {
+		return b
+	}
+
+	if ints {
+		b = append(b, binInts)
+	} else {
+		b = append(b, binFloats)
+	}
+
+	// run lengths are only known at the end of the run,
+	// so collect the counts of the current run first.
+
+	var buf [16]float64
+
+	run := buf[:0]
+	start := 0
+
+	flush := func() {
+		b = binary.AppendUvarint(b, uint64(len(run)))
+
+		for _, w := range run {
+			if ints {
+				b = binary.AppendUvarint(b, uint64(w))
+			} else {
+				b = binAppendFloat64(b, w)
+			}
+		}
+
+		run = run[:0]
+	}
+
+	st.each(func(key int, w float64) {
+		switch {
+		case len(run) == 0:
+			b = binary.AppendVarint(b, int64(key))
+			start = key
+		case key != start+len(run):
+			flush()
+
+			b = binary.AppendUvarint(b, uint64(key-next-1))
+			start = key
+		}
+
+		run = append(run, w)
+		next = key + 1
+	})
+
+	flush()
+
+	return b
+}
+
+func binDecodeStoreCompact(st ddstore, r *binReader) {
+	runs := r.len(r.left() / 2)
+	if r.err != nil || runs == 0 {
+		return
+	}
+
+	kind := r.byte()
+	if kind != binFloats && kind != binInts {
+		r.err = ErrMalformed
+		return
+	}
+
+	first := r.int()
+	key := first
+
+	for i := range runs {
+		if i != 0 {
+			key += r.len(math.MaxInt32) + 1
+		}
+
+		n := r.len(r.left())
+
+		if r.err == nil && (n == 0 || key+n-1 > math.MaxInt32 ||
+			st.kind()&ddKindMask == DDDense && key+n-first > binMaxAlloc) {
+			r.err = ErrMalformed
+		}
+
+		if r.err != nil {
+			return
+		}
+
+		for range n {
+			var w float64
+
+			if kind == binInts {
+				w = float64(r.uvarint())
+			} else {
+				w = r.float64()
+			}
+
+			if r.err == nil && (w == 0 || !binIsCount(w)) {
+				r.err = ErrMalformed
+			}
+
+			if r.err != nil {
+				return
+			}
+
+			st.add(key, w, 0)
+			key++
+		}
+	}
+}
+
+// binIsInt reports whether w is encoded as uvarint exactly.
+func binIsInt(w float64) bool {
+	return w >= 0 && w < 1<<63 && w == math.Trunc(w) && !math.Signbit(w)
+}
+
+// write writes n lowest bits of x.
+func (w *binBitWriter) write(x uint64, n uint) {
+	if n > 32 {
+		w.write(x>>32, n-32)
+		n = 32
+	}
+
+	w.acc = w.acc<<n | x&(1<<n-1)
+	w.n += n
+
+	for w.n >= 8 {
+		w.n -= 8
+		w.b = append(w.b, byte(w.acc>>w.n))
+	}
+}
+
+func (w *binBitWriter) flush() []byte {
+	if w.n != 0 {
+		w.b = append(w.b, byte(w.acc<<(8-w.n)))
+		w.n = 0
+	}
+
+	return w.b
+}
+
+// read reads n bits, the rest of the last byte is dropped when the reader is discarded.
+func (r *binBitReader) read(n uint) uint64 {
+	if n > 32 {
+		hi := r.read(n - 32)
+
+		return hi<<32 | r.read(32)
+	}
+
+	for r.n < n {
+		b := r.r.byte()
+		if r.r.err != nil {
+			return 0
+		}
+
+		r.acc = r.acc<<8 | uint64(b)
+		r.n += 8
+	}
+
+	r.n -= n
+
+	return r.acc >> r.n & (1<<n - 1)
+}
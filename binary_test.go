@@ -0,0 +1,487 @@
+package quantile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"hash/crc32"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// binarySketches returns filled sketches of every type
+// which data is deterministic, so their encodings are too.
+func binarySketches() map[string]Marshaler {
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+
+	ss := map[string]Marshaler{
+		"tdigest":      NewTDExtremesBiased(0.01, 64),
+		"ddlog":        NewDDLog(0.01),
+		"ddlog_sparse": NewDDLogStore(0.02, DDSparse|DDUint64),
+		"kll":          NewKLL(16, 8),
+		"exact":        &Exact{Method: ExactLinear},
+		"ostree":       NewOSTree(),
+	}
+
+	dd := ss["ddlog"].(*DDLog)
+	dd.MaxBins = 64
+
+	for i := range 1000 {
+		v := 100 + 10*r.NormFloat64()
+		if i%10 == 0 {
+			v = -v
+		}
+
+		for _, s := range ss {
+			s.Insert(v)
+		}
+	}
+
+	for _, s := range ss {
+		s.InsertWeighted(0, 3)
+	}
+
+	return ss
+}
+
+func TestBinaryRoundTrip(tb *testing.T) {
+	qs := []float64{0, 0.01, 0.1, 0.5, 0.9, 0.99, 1}
+
+	for name, s := range binarySketches() {
+		tb.Run(name, func(tb *testing.T) {
+			data, err := s.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			s1 := newZeroSketch(s)
+
+			err = s1.UnmarshalBinary(data)
+			if err != nil {
+				tb.Fatalf("unmarshal: %v", err)
+			}
+
+			if s.Count() != s1.Count() {
+				tb.Errorf("count: %v, want %v", s1.Count(), s.Count())
+			}
+
+			for _, q := range qs {
+				if v, v1 := s.Query(q), s1.Query(q); v != v1 {
+					tb.Errorf("query %v: %v, want %v", q, v1, v)
+				}
+			}
+
+			for _, v := range []float64{-100, 0, 90, 100, 110} {
+				if r, r1 := s.Rank(v), s1.Rank(v); r != r1 {
+					tb.Errorf("rank %v: %v, want %v", v, r1, r)
+				}
+			}
+
+			data1, err := s1.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			if !bytes.Equal(data, data1) {
+				tb.Errorf("encoding differs after round trip")
+			}
+
+			comp, err := s.(compactMarshaler).MarshalCompact()
+			if err != nil {
+				tb.Fatalf("marshal compact: %v", err)
+			}
+
+			s2 := newZeroSketch(s)
+
+			err = s2.UnmarshalBinary(comp)
+			if err != nil {
+				tb.Fatalf("unmarshal compact: %v", err)
+			}
+
+			data2, err := s2.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			if !bytes.Equal(data, data2) {
+				tb.Errorf("compact decoded differently")
+			}
+
+			tb.Logf("size: binary %d, compact %d", len(data), len(comp))
+
+			pref := []byte("prefix")
+
+			app, err := s.(interface {
+				AppendBinary([]byte) ([]byte, error)
+			}).AppendBinary(pref)
+			if err != nil || !bytes.Equal(app[:len(pref)], pref) || !bytes.Equal(app[len(pref):], data) {
+				tb.Errorf("append binary: %v", err)
+			}
+		})
+	}
+}
+
+func TestBinaryErrors(tb *testing.T) {
+	s := NewTDLowBiased(0.01, 16)
+	s.Insert(1)
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    func(p []byte) []byte
+		err  error
+	}{
+		{"checksum", func(p []byte) []byte { p[5]++; return p }, ErrChecksum},
+		{"type", func(p []byte) []byte { p[1] = binDDLog; return p }, ErrTypeMismatch},
+		{"version", func(p []byte) []byte { p[2]++; return p }, ErrUnsupportedVersion},
+		{"truncated", func(p []byte) []byte { return p[:len(p)-5] }, ErrMalformed},
+		{"trailing", func(p []byte) []byte { return append(p[:len(p)-4], 0) }, ErrMalformed},
+		{"short", func(p []byte) []byte { return p[:3] }, ErrMalformed},
+	} {
+		p := tc.f(bytes.Clone(data))
+
+		if tc.err != ErrChecksum && len(p) >= binHeaderLen+binCRCLen {
+			p = binary.LittleEndian.AppendUint32(p[:len(p)-4], crc32.Checksum(p[:len(p)-4], binCRC))
+		}
+
+		err := s.UnmarshalBinary(p)
+		if !errors.Is(err, tc.err) {
+			tb.Errorf("%v: %v, want %v", tc.name, err, tc.err)
+		}
+	}
+
+	if s.Count() != 1 {
+		tb.Errorf("sketch is changed by failed unmarshal")
+	}
+
+	s.Invariant = InvariantFunc(func(q float32) float32 { return 0.01 })
+
+	_, err = s.MarshalBinary()
+	if !errors.Is(err, ErrUnsupportedInvariant) {
+		tb.Errorf("invariant func: %v", err)
+	}
+}
+
+func TestBinaryWeights(tb *testing.T) {
+	td := NewTDLowBiased(0.01, 16)
+	td.Insert(1)
+
+	ex := NewExact()
+	ex.InsertWeighted(1, 2)
+
+	// the last weight goes right before the checksum in both
+	for _, s := range []Marshaler{td, ex} {
+		data, err := s.MarshalBinary()
+		if err != nil {
+			tb.Fatalf("marshal: %v", err)
+		}
+
+		for _, w := range []float32{-1, float32(math.NaN())} {
+			p := bytes.Clone(data)
+
+			binary.LittleEndian.PutUint32(p[len(p)-8:], math.Float32bits(w))
+			p = binary.LittleEndian.AppendUint32(p[:len(p)-4], crc32.Checksum(p[:len(p)-4], binCRC))
+
+			err = s.UnmarshalBinary(p)
+			if !errors.Is(err, ErrMalformed) {
+				tb.Errorf("%T: weight %v: %v", s, w, err)
+			}
+		}
+	}
+
+	// zero weight is a valid TDigest state, but Exact never keeps it
+	td.AdjustWeights(0)
+
+	data, err := td.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	err = td.UnmarshalBinary(data)
+	if err != nil {
+		tb.Errorf("tdigest: zero weight: %v", err)
+	}
+
+	data, err = ex.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	binary.LittleEndian.PutUint32(data[len(data)-8:], 0)
+	data = binary.LittleEndian.AppendUint32(data[:len(data)-4], crc32.Checksum(data[:len(data)-4], binCRC))
+
+	err = ex.UnmarshalBinary(data)
+	if !errors.Is(err, ErrMalformed) {
+		tb.Errorf("exact: zero weight: %v", err)
+	}
+}
+
+func TestBinaryDDCounts(tb *testing.T) {
+	s := NewDDLog(0.01)
+	s.Insert(1)
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	// header, interp, gamma, offset, kind, max bins, collapse
+	zeros := binHeaderLen + 1 + 8 + 8 + 1 + 1 + 1
+	// the only bin count goes before empty neg store and the checksum
+	bin := len(data) - binCRCLen - 3 - 8
+
+	if math.Float64frombits(binary.LittleEndian.Uint64(data[bin:])) != 1 {
+		tb.Fatalf("bin count is not found")
+	}
+
+	for _, tc := range []struct {
+		name string
+		pos  int
+		v    float64
+	}{
+		{"zeros_negative", zeros, -1},
+		{"zeros_nan", zeros, math.NaN()},
+		{"zeros_inf", zeros, math.Inf(1)},
+		{"min_nan", zeros + 8, math.NaN()},
+		{"max_nan", zeros + 16, math.NaN()},
+		{"sum_nan", zeros + 24, math.NaN()},
+		{"bin_inf", bin, math.Inf(1)},
+		{"bin_nan", bin, math.NaN()},
+	} {
+		p := bytes.Clone(data)
+
+		binary.LittleEndian.PutUint64(p[tc.pos:], math.Float64bits(tc.v))
+		p = binary.LittleEndian.AppendUint32(p[:len(p)-4], crc32.Checksum(p[:len(p)-4], binCRC))
+
+		err = s.UnmarshalBinary(p)
+		if !errors.Is(err, ErrMalformed) {
+			tb.Errorf("%v: %v", tc.name, err)
+		}
+
+		_, err = NewDDLogView(p)
+		if !errors.Is(err, ErrMalformed) {
+			tb.Errorf("%v: view: %v", tc.name, err)
+		}
+	}
+
+	if s.Count() != 1 {
+		tb.Errorf("sketch is changed by failed unmarshal")
+	}
+}
+
+// TestBinaryGolden catches format changes.
+// Run with -update to rewrite the files if the change is intended.
+func TestBinaryGolden(tb *testing.T) {
+	for name, s := range binarySketches() {
+		for _, compact := range []bool{false, true} {
+			testBinaryGolden(tb, name, s, compact)
+		}
+	}
+}
+
+func testBinaryGolden(tb *testing.T, name string, s Marshaler, compact bool) {
+	path := filepath.Join("testdata", name+".bin")
+	marshal := s.MarshalBinary
+
+	if compact {
+		path = filepath.Join("testdata", name+"_compact.bin")
+		marshal = s.(compactMarshaler).MarshalCompact
+	}
+
+	data, err := marshal()
+	if err != nil {
+		tb.Fatalf("%v: marshal: %v", path, err)
+	}
+
+	if *update {
+		err = os.WriteFile(path, data, 0o644)
+		if err != nil {
+			tb.Fatalf("%v: write: %v", path, err)
+		}
+
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("%v: read: %v", path, err)
+	}
+
+	if !bytes.Equal(data, golden) {
+		tb.Errorf("%v: encoding differs", path)
+	}
+
+	s1 := newZeroSketch(s)
+
+	err = s1.UnmarshalBinary(golden)
+	if err != nil {
+		tb.Errorf("%v: unmarshal golden: %v", path, err)
+		return
+	}
+
+	if s.Count() != s1.Count() || s.Query(0.5) != s1.Query(0.5) {
+		tb.Errorf("%v: golden decoded differently", path)
+	}
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, s := range binarySketches() {
+		data, err := s.MarshalBinary()
+		if err != nil {
+			f.Fatalf("marshal: %v", err)
+		}
+
+		f.Add(data)
+
+		data, err = s.(compactMarshaler).MarshalCompact()
+		if err != nil {
+			f.Fatalf("marshal compact: %v", err)
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(tb *testing.T, p []byte) {
+		// fix the checksum, so mutations reach the decoder
+		if len(p) >= binHeaderLen+binCRCLen {
+			end := len(p) - binCRCLen
+			binary.LittleEndian.PutUint32(p[end:], crc32.Checksum(p[:end], binCRC))
+		}
+
+		var tv TDigestView
+		var dv DDLogView
+
+		if tv.Load(p) == nil {
+			_ = tv.Query(0.5)
+			_ = tv.Rank(1)
+		}
+
+		if dv.Load(p) == nil {
+			_ = dv.Query(0.5)
+			_ = dv.Rank(1)
+		}
+
+		for _, s := range []Marshaler{&TDigest{}, &DDLog{}, &KLL{}, &Exact{}, &OSTree{}} {
+			err := s.UnmarshalBinary(p)
+			if err != nil {
+				continue
+			}
+
+			_ = s.Query(0.5)
+			_ = s.Rank(1)
+
+			data, err := s.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal decoded: %v", err)
+			}
+
+			s1 := newZeroSketch(s)
+
+			err = s1.UnmarshalBinary(data)
+			if err != nil {
+				tb.Fatalf("unmarshal encoded: %v", err)
+			}
+
+			data1, err := s1.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal decoded: %v", err)
+			}
+
+			if !bytes.Equal(data, data1) {
+				tb.Errorf("round trip differs\n%x\n%x", data, data1)
+			}
+
+			comp, err := s1.(compactMarshaler).MarshalCompact()
+			if err != nil {
+				tb.Fatalf("marshal compact: %v", err)
+			}
+
+			s2 := newZeroSketch(s)
+
+			err = s2.UnmarshalBinary(comp)
+			if err != nil {
+				tb.Fatalf("unmarshal compact: %v", err)
+			}
+
+			data2, err := s2.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal decoded: %v", err)
+			}
+
+			if !bytes.Equal(data, data2) {
+				tb.Errorf("compact round trip differs\n%x\n%x", data, data2)
+			}
+		}
+	})
+}
+
+type compactMarshaler interface {
+	MarshalCompact() ([]byte, error)
+}
+
+func BenchmarkBinarySize(tb *testing.B) {
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+
+	for _, tc := range []struct {
+		name string
+		s    Marshaler
+	}{
+		{"TDigest512", NewTDExtremesBiased(0.01, 512)},
+		{"DDLog", NewDDLog(0.01)},
+		{"DDLogSparse", NewDDLogStore(0.01, DDSparse|DDUint64)},
+		{"KLL", NewKLL(128, 16)},
+	} {
+		for range 100000 {
+			tc.s.Insert(math.Exp(r.NormFloat64())) // latency-like
+		}
+
+		for _, compact := range []bool{false, true} {
+			name := tc.name + "/Binary"
+			marshal := tc.s.MarshalBinary
+
+			if compact {
+				name = tc.name + "/Compact"
+				marshal = tc.s.(compactMarshaler).MarshalCompact
+			}
+
+			tb.Run(name, func(tb *testing.B) {
+				tb.ReportAllocs()
+
+				var data []byte
+
+				for i := 0; i < tb.N; i++ {
+					data, _ = marshal()
+				}
+
+				tb.ReportMetric(float64(len(data)), "bytes/sketch")
+			})
+		}
+	}
+}
+
+func newZeroSketch(s Marshaler) Marshaler {
+	switch s.(type) {
+	case *TDigest:
+		return &TDigest{}
+	case *DDLog:
+		return &DDLog{}
+	case *KLL:
+		return &KLL{}
+	case *Exact:
+		return &Exact{}
+	case *OSTree:
+		return &OSTree{}
+	default:
+		panic(s)
+	}
+}
@@ -5,180 +5,1237 @@ package quantile
 // https://github.com/ClickHouse/ClickHouse/blob/master/src/AggregateFunctions/DDSketch.h
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"slices"
 	"strings"
+	"unsafe"
 )
 
 type (
 	DDLog struct {
-		pos, neg ddstorage
+		pos, neg ddstore
 		zeros    float64
+		integer  bool // zeros are rounded as DDUint64 bins are
 
-		gamma, multiplier        float64
+		min, max, sum float64
+
+		m                        IndexMapping
 		minPossible, maxPossible float64
+
+		// MaxBins limits the number of bins in each of positive and negative stores.
+		// Zero means no limit.
+		// When the limit is reached bins are collapsed according to Collapse strategy
+		// and quantiles falling into the collapsed bin lose the accuracy guarantee.
+		MaxBins  int
+		Collapse DDCollapse
+
+		// ShrinkBins makes Reset release a store memory
+		// if it has more than ShrinkBins bins allocated.
+		// Zero means the memory is always kept for reuse.
+		ShrinkBins int
+
+		// Interpolate makes Rank and CDF count the part of v bin weight
+		// proportional to v position in the bin instead of the whole bin.
+		Interpolate bool
+
+		// Collapses counts insert, merge and decode calls
+		// which collapsed bins to fit MaxBins.
+		// Decoding starts it from zero, Reset keeps it.
+		Collapses int
+	}
+
+	// ddstore is a set of bins indexed by key.
+	ddstore interface {
+		// add adds w to key bin growing the storage if needed.
+		add(key int, w float64, limit int)
+		// sub subtracts up to w from key bin and returns how much was subtracted.
+		sub(key int, w float64) float64
+		// reserve prepares storage to hold [lo, hi] keys.
+		reserve(lo, hi, limit int)
+		adjust(multiply float64)
+		// reset empties the store keeping up to shrink bins allocated, 0 means no limit.
+		reset(shrink int)
+
+		sum() float64
+		// bounds returns the lowest and the highest keys stored.
+		bounds() (lo, hi int, ok bool)
+		// find returns the first key cumulative weight up to which
+		// (inclusive) exceeds or reaches (if eq) limit.
+		find(limit float64, eq bool) int
+		// rank returns the total weight of bins below key and key bin weight.
+		rank(key int) (below, w float64)
+		// each calls f for each non-empty bin in ascending key order.
+		each(f func(key int, w float64))
+		// nextBin returns the first non-empty bin at or after i position and the position after it.
+		// Positions start from 0. It's each without a closure for allocation free loops.
+		nextBin(i int) (key int, w float64, next int, ok bool)
+
+		foldBelow(l int) bool
+		foldAbove(h int) bool
+
+		collapsedKey() (int, bool)
+		markCollapsed(key int)
+
+		kind() DDStore
+		// size returns the memory used by bins in bytes.
+		size() int
+	}
+
+	// ddcount is a bin count type.
+	ddcount interface {
+		float32 | float64 | uint64
+	}
+
+	// ddmulti is QueryMulti state.
+	ddmulti struct {
+		s       *DDLog
+		qs, res []float64
+		idx     []int // qs indexes sorted by quantile
+
+		total, base, cum float64
+		j, last          int
+		more             bool
 	}
 
-	ddstorage struct {
-		bins   []float32
+	ddbase[T ddcount] struct {
+		total T
+
+		ckey      int // collapsed bin key
+		collapsed bool
+	}
+
+	ddstorage[T ddcount] struct {
+		ddbase[T]
+
+		bins   []T
 		offset int
-		total  float64
 	}
+
+	// DDStore selects DDLog bins storage and counts type.
+	// Storage kind and counts type are combined like DDSparse|DDUint64.
+	DDStore int
+
+	// DDCollapse is a strategy of limiting DDLog memory usage.
+	DDCollapse int
+)
+
+const (
+	// DDDense stores bins in a contiguous slice.
+	// It's the fastest one if values are within a few orders of magnitude.
+	DDDense DDStore = iota
+
+	// DDSparse stores only non-empty bins as sorted key/weight pairs.
+	// It uses less memory for widely spread values, like multimodal latencies.
+	DDSparse
+
+	ddKindMask DDStore = 0xf
+)
+
+const (
+	// DDFloat32 counts are compact, but a bin stops growing at 2^24 hits.
+	DDFloat32 DDStore = iota << 4
+
+	// DDFloat64 counts are for weighted data, they are exact up to 2^53 hits.
+	DDFloat64
+
+	// DDUint64 counts are integers, weights are rounded to the nearest integer.
+	// Bins are uint64, but weights pass through float64 on insert, merge, query and encoding,
+	// so counts are exact up to 2^53 hits as with DDFloat64.
+	DDUint64
+
+	ddCountsMask DDStore = 0xf0
 )
 
+const (
+	// CollapseLowest merges the lowest magnitude bins together.
+	// Accuracy is lost for values closest to zero.
+	CollapseLowest DDCollapse = iota
+
+	// CollapseHighest merges the highest magnitude bins together.
+	// Accuracy is lost for values farthest from zero.
+	CollapseHighest
+)
+
+var ErrMappingMismatch = errors.New("index mapping mismatch")
+
 func NewDDLog(relAcc float64) *DDLog {
-	gamma := (1 + relAcc) / (1 - relAcc)
+	return NewDDLogStore(relAcc, DDDense)
+}
+
+// NewDDLogStore creates DDLog with st bins storage and counts type.
+func NewDDLogStore(relAcc float64, st DDStore) *DDLog {
+	return NewDDLogMapping(NewLogMapping(relAcc), st)
+}
 
+// NewDDLogMapping creates DDLog with custom index mapping.
+// LinearMapping and CubicMapping make Insert faster
+// at the cost of more bins for the same accuracy.
+func NewDDLogMapping(m IndexMapping, st DDStore) *DDLog {
 	return &DDLog{
-		gamma:       gamma,
-		multiplier:  1 / math.Log(gamma),
-		minPossible: math.SmallestNonzeroFloat64 * gamma,
-		maxPossible: math.MaxFloat64 / gamma,
+		pos: newDDStore(st),
+		neg: newDDStore(st),
+
+		m:           m,
+		minPossible: m.MinIndexable(),
+		maxPossible: m.MaxIndexable(),
+
+		integer: st&ddCountsMask == DDUint64,
+
+		min: math.Inf(1),
+		max: math.Inf(-1),
 	}
 }
 
+// Reset clears s keeping the mapping, settings and allocated memory.
+func (s *DDLog) Reset() {
+	s.pos.reset(s.ShrinkBins)
+	s.neg.reset(s.ShrinkBins)
+
+	s.zeros = 0
+	s.resetStats()
+}
+
+// Query returns q quantile estimate.
+// The result is within relative accuracy from the exact value,
+// which is sorted[int(q*n)] for n inserted values.
+// It's clamped to [Min, Max] range, so Query(0) and Query(1) are exact.
 func (s *DDLog) Query(q float64) float64 {
-	total := s.neg.total + s.zeros + s.pos.total
+	if s.Count() == 0 {
+		return 0
+	}
+
+	b, key := s.locate(q)
+
+	switch {
+	case q <= 0 && s.holds(b, key, s.min):
+		return s.min
+	case q >= 1 && s.holds(b, key, s.max):
+		return s.max
+	}
+
+	return s.value(b, key)
+}
+
+// QueryMulti makes multiple queries at once walking the bins once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+func (s *DDLog) QueryMulti(qs, res []float64) {
+	var buf [8]int
+
+	w := ddmulti{s: s, qs: qs, res: res, total: s.Count(), idx: buf[:0]}
+
+	for i, q := range qs {
+		if w.total == 0 || q <= 0 || q >= 1 {
+			res[i] = s.Query(q)
+			continue
+		}
+
+		w.idx = append(w.idx, i)
+	}
+
+	slices.SortFunc(w.idx, func(a, b int) int { return cmp.Compare(qs[a], qs[b]) })
+
+	negSum, posSum := s.neg.sum(), s.pos.sum()
+
+	neg := 0
+	for neg < len(w.idx) && qs[w.idx[neg]]*w.total < negSum {
+		neg++
+	}
+
+	pos := neg
+	for pos < len(w.idx) && w.total-qs[w.idx[pos]]*w.total > posSum {
+		res[w.idx[pos]] = s.value(nil, 0)
+		pos++
+	}
+
+	// neg bins go from 0 toward -Inf, so the highest quantiles come first
+	w.j, w.base = neg-1, negSum
+	w.walk(s.neg)
+
+	w.j, w.base = pos, negSum+s.zeros
+	w.walk(s.pos)
+}
+
+// walk calls bin with cumulative weight up to each non-empty bin inclusive until it returns false.
+// The last bin is reported once more with infinite weight, so that all the queries are answered
+// regardless of rounding errors.
+func (w *ddmulti) walk(b ddstore) {
+	w.cum, w.last, w.more = 0, 0, true
+
+	for i := 0; w.more; {
+		key, x, next, ok := b.nextBin(i)
+		if !ok {
+			break
+		}
+
+		w.cum += x
+		w.last = key
+		w.more = w.bin(b, key)
+		i = next
+	}
+
+	if w.more {
+		w.cum = math.Inf(1)
+		w.bin(b, w.last)
+	}
+}
+
+func (w *ddmulti) bin(b ddstore, key int) bool {
+	if b == w.s.neg {
+		return w.negBin(b, key)
+	}
+
+	return w.posBin(b, key)
+}
+
+func (w *ddmulti) negBin(b ddstore, key int) bool {
+	for ; w.j >= 0 && w.cum >= w.base-w.qs[w.idx[w.j]]*w.total; w.j-- {
+		w.res[w.idx[w.j]] = w.s.value(b, key)
+	}
+
+	return w.j >= 0
+}
+
+func (w *ddmulti) posBin(b ddstore, key int) bool {
+	for ; w.j < len(w.idx) && w.cum > w.qs[w.idx[w.j]]*w.total-w.base; w.j++ {
+		w.res[w.idx[w.j]] = w.s.value(b, key)
+	}
+
+	return w.j < len(w.idx)
+}
+
+// value returns the representative of key bin of b clamped to [min, max].
+// nil storage means zero bucket.
+func (s *DDLog) value(b ddstore, key int) float64 {
+	var v float64
+
+	if b != nil {
+		v = s.m.Value(key)
+	}
+
+	if b == s.neg {
+		v = -v
+	}
+
+	return min(max(v, s.min), s.max)
+}
+
+// QueryBounds returns the range of values of the bin q quantile falls into.
+// The exact quantile value v is in [lo, hi) range.
+// For negative values the range is (lo, hi] and for the zero bucket it's (lo, hi).
+func (s *DDLog) QueryBounds(q float64) (lo, hi float64) {
+	b, key := s.locate(q)
+	if b == nil {
+		if s.Count() == 0 {
+			return 0, 0
+		}
+
+		return -s.minPossible, s.minPossible
+	}
+
+	lo, hi = s.m.LowerBound(key), s.m.LowerBound(key+1)
+
+	if b == s.neg {
+		lo, hi = -hi, -lo
+	}
+
+	return lo, hi
+}
+
+// Accurate reports whether Query(q) result is within the relative accuracy guarantee.
+// It's false if the quantile falls into a bin where other bins were collapsed to.
+func (s *DDLog) Accurate(q float64) bool {
+	b, key := s.locate(q)
+	if b == nil {
+		return true
+	}
+
+	ckey, collapsed := b.collapsedKey()
+
+	return !collapsed || key != ckey
+}
+
+// Rank returns the estimated total weight of values less than or equal to v.
+// The whole v bin weight is counted unless Interpolate is set.
+func (s *DDLog) Rank(v float64) float64 {
+	total := s.Count()
+
+	switch {
+	case total == 0 || v < s.min:
+		return 0
+	case v >= s.max:
+		return total
+	}
+
+	b, key := s.bin(v)
+
+	if b == nil {
+		if s.Interpolate && v < 0 {
+			return s.neg.sum()
+		}
+
+		return s.neg.sum() + s.zeros
+	}
+
+	below, w := b.rank(key)
+
+	return s.rank(b, key, v, below, w)
+}
+
+// rank returns Rank(v) for v in key bin of b
+// with below weight in the lower bins and w in the key bin.
+func (s *DDLog) rank(b ddstore, key int, v, below, w float64) float64 {
+	part := w
+
+	if s.Interpolate {
+		lo, hi := s.m.LowerBound(key), s.m.LowerBound(key+1)
+		f := min(max((math.Abs(v)-lo)/(hi-lo), 0), 1)
+
+		if b == s.neg {
+			f = 1 - f
+		}
+
+		part = w * f
+	}
+
+	if b == s.neg {
+		// neg bins are ordered by magnitude, so values below v are in the higher keys
+		return s.neg.sum() - below - w + part
+	}
+
+	return s.neg.sum() + s.zeros + below + part
+}
+
+// CDF returns the estimated fraction of values less than or equal to v.
+func (s *DDLog) CDF(v float64) float64 {
+	total := s.Count()
 	if total == 0 {
 		return 0
 	}
 
+	return s.Rank(v) / total
+}
+
+// CDFMulti is CDF for multiple values walking the bins once.
+// res[i] is set to CDF(vs[i]), res must be at least len(vs) long.
+func (s *DDLog) CDFMulti(vs, res []float64) {
+	total := s.Count()
+
+	idx := make([]int, 0, len(vs))
+
+	for i, v := range vs {
+		if b, _ := s.bin(v); total == 0 || b == nil || !(v >= s.min && v < s.max) {
+			res[i] = s.CDF(v)
+			continue
+		}
+
+		idx = append(idx, i)
+	}
+
+	slices.SortFunc(idx, func(a, b int) int { return cmp.Compare(vs[a], vs[b]) })
+
+	neg := 0
+	for neg < len(idx) && vs[idx[neg]] < 0 {
+		neg++
+	}
+
+	s.cdfWalk(s.neg, vs, res, idx[:neg], total)
+	s.cdfWalk(s.pos, vs, res, idx[neg:], total)
+}
+
+// cdfWalk sets res for vs[idx] all falling into b bins.
+// idx is sorted by value, so keys go in the same order for pos and in the reverse order for neg.
+func (s *DDLog) cdfWalk(b ddstore, vs, res []float64, idx []int, total float64) {
+	var below float64
+	var j, i, key int
+
+	next := func() bool {
+		if j == len(idx) {
+			return false
+		}
+
+		i = idx[j]
+		if b == s.neg {
+			i = idx[len(idx)-1-j]
+		}
+
+		_, key = s.bin(vs[i])
+		j++
+
+		return true
+	}
+
+	more := next()
+
+	b.each(func(bkey int, w float64) {
+		for ; more && key < bkey; more = next() {
+			res[i] = s.rank(b, key, vs[i], below, 0) / total
+		}
+
+		for ; more && key == bkey; more = next() {
+			res[i] = s.rank(b, key, vs[i], below, w) / total
+		}
+
+		below += w
+	})
+
+	for ; more; more = next() {
+		res[i] = s.rank(b, key, vs[i], below, 0) / total
+	}
+}
+
+// locate finds the storage and the bin key q quantile falls into.
+// nil storage means zero bucket.
+func (s *DDLog) locate(q float64) (ddstore, int) {
+	total := s.Count()
+	if total == 0 {
+		return nil, 0
+	}
+
 	if q <= 0 {
 		switch {
-		case s.neg.total != 0:
-			return -s.unkey(s.neg.offset + len(s.neg.bins))
+		case s.neg.sum() != 0:
+			_, hi, _ := s.neg.bounds()
+			return s.neg, hi
 		case s.zeros != 0:
-			return 0
+			return nil, 0
 		default:
-			return s.unkey(s.pos.offset)
+			lo, _, _ := s.pos.bounds()
+			return s.pos, lo
 		}
 	}
 	if q >= 1 {
 		switch {
-		case s.pos.total != 0:
-			return s.unkey(s.pos.offset + len(s.pos.bins))
+		case s.pos.sum() != 0:
+			_, hi, _ := s.pos.bounds()
+			return s.pos, hi
 		case s.zeros != 0:
-			return 0
+			return nil, 0
 		default:
-			return -s.unkey(s.neg.offset)
+			lo, _, _ := s.neg.bounds()
+			return s.neg, lo
 		}
 	}
 
 	target := q * total
 
-	var limit float64
-	b := &s.pos
-
-	//	log.Printf("query %.3f %6.1f of %6.1f  (%.1f + %.1f + %.1f)", q, target, total, s.neg.total, s.zeros, s.pos.total)
+	//	log.Printf("query %.3f %6.1f of %6.1f  (%.1f + %.1f + %.1f)", q, target, total, s.neg.sum(), s.zeros, s.pos.sum())
 
 	switch {
-	case target < s.neg.total:
-		b = &s.neg
-		limit = s.neg.total - target // going from 0 to -Inf
-	case total-target <= s.pos.total:
-		limit = target - (s.neg.total + s.zeros)
+	case target < s.neg.sum():
+		// going from 0 to -Inf, looking for the last bin
+		// with more than target weight at or below it
+		return s.neg, s.neg.find(s.neg.sum()-target, true)
+	case total-target <= s.pos.sum():
+		return s.pos, s.pos.find(target-(s.neg.sum()+s.zeros), false)
+	default:
+		return nil, 0
+	}
+}
+
+// Insert adds v.
+// NaN and infinities are ignored as they can't be indexed.
+func (s *DDLog) Insert(v float64) {
+	s.insert(v, 1)
+}
+
+// InsertWeight is an alias for InsertWeighted.
+//
+// Deprecated: Use InsertWeighted.
+func (s *DDLog) InsertWeight(v float64, w float32) {
+	s.InsertWeighted(v, w)
+}
+
+// InsertWeighted adds v with weight w.
+// Negative w removes the weight from the v bin, see Remove.
+func (s *DDLog) InsertWeighted(v float64, w float32) {
+	if w < 0 {
+		s.remove(v, -float64(w))
+		return
+	}
+
+	wf := s.round(float64(w))
+	if !(wf > 0) {
+		return
+	}
+
+	s.insert(v, wf)
+}
+
+func (s *DDLog) insert(v, wf float64) {
+	// bin is inlined here as Insert is the hottest path
+	b, x := s.pos, v
+
+	if v < 0 {
+		b, x = s.neg, -v
+	}
+
+	if !(x <= math.MaxFloat64) { // NaN and Inf can't be indexed
+		return
+	}
+
+	s.observe(v, v, v*wf)
+
+	if x < s.minPossible {
+		s.zeros += wf
+		return
+	}
+
+	key := s.key(x)
+
+	//	log.Printf("insert %.3v  key %d", v, key)
+
+	if s.MaxBins <= 0 {
+		b.add(key, wf, 0)
+		return
+	}
+
+	if ddinsert(b, key, wf, s.MaxBins, s.Collapse) {
+		s.Collapses++
+	}
+}
+
+func (s *DDLog) remove(v, w float64) {
+	if !(math.Abs(v) <= math.MaxFloat64) {
+		return
+	}
+
+	b, key := s.bin(v)
+	if b == nil {
+		w = min(s.round(w), s.zeros)
+		s.zeros -= w
+	} else {
+		w = ddremove(b, key, w, s.Collapse)
+	}
+
+	s.sum -= v * w
+	s.fixStats()
+}
+
+// Remove removes previously inserted v.
+//
+// Values are removed by bin, so removing a value which was never inserted
+// removes another value from the same bin if there is one.
+// Bins never go negative: removing more than a bin holds empties it
+// and the excess is ignored, so totals always match the bins.
+//
+// Sum is decreased by the value times the removed weight.
+// Min and Max are kept, so they become the bounds rather than exact values.
+func (s *DDLog) Remove(v float64) {
+	s.InsertWeighted(v, -1)
+}
+
+// Subtract removes s1 data from s.
+// It's useful to convert cumulative sketches into deltas
+// and to implement sliding windows by subtracting old snapshots.
+//
+// Mappings requirements are the same as for MergeWeighted.
+// Bins are clamped at zero the same way as in Remove.
+// Sum is decreased by s1 sum, which is exact only if s1 is a subset of s.
+func (s *DDLog) Subtract(s1 *DDLog) error {
+	return s.MergeWeighted(s1, 1, -1)
+}
+
+// Merge adds s1 bins to s.
+// See MergeWeighted for requirements.
+func (s *DDLog) Merge(s1 *DDLog) error {
+	return s.MergeWeighted(s1, 1, 1)
+}
+
+// MergeWeighted multiplies s weights by w0 and adds s1 weights multiplied by w1.
+// Non-positive w0 clears s, negative w1 subtracts s1 as Subtract does.
+//
+// Sketches must have the same index mapping,
+// or one must be a downscaled version of the other.
+// In the latter case the finer sketch data is downscaled to the coarser resolution first.
+// s1 is never modified, unless it's s, which is weighted by w0+w1 then.
+func (s *DDLog) MergeWeighted(s1 *DDLog, w0, w1 float32) error {
+	if s1 == s {
+		// the bins can't be walked while they are changed,
+		// and s1 weights must be taken before s adjustment
+		s.AdjustWeights(w0 + w1)
+		return nil
+	}
+
+	if s.m != s1.m {
+		f, ok := ddScaleDiff(s.m, s1.m)
+		if !ok || f == 0 {
+			return ErrMappingMismatch
+		}
+
+		if f > 0 {
+			s.downscale(f, s1.m)
+		} else {
+			s1 = s1.downscaled(-f, s.m)
+		}
+	}
+
+	s.AdjustWeights(w0)
+
+	if ddmerge(s.pos, s1.pos, float64(w1), s.MaxBins, s.Collapse) {
+		s.Collapses++
+	}
+	if ddmerge(s.neg, s1.neg, float64(w1), s.MaxBins, s.Collapse) {
+		s.Collapses++
+	}
+
+	s.zeros = max(0, s.zeros+s.round(s1.zeros*float64(w1)))
+
+	if w1 > 0 && s1.Count() != 0 {
+		s.min = min(s.min, s1.min)
+		s.max = max(s.max, s1.max)
+	}
+
+	s.sum += s1.sum * float64(w1)
+	s.fixStats()
+
+	return nil
+}
+
+// AdjustWeights multiplies all the weights by multiply.
+// Non-positive multiply clears s.
+func (s *DDLog) AdjustWeights(multiply float32) {
+	if multiply == 1 {
+		return
+	}
+
+	multiply = max(0, multiply)
+
+	s.pos.adjust(float64(multiply))
+	s.neg.adjust(float64(multiply))
+	s.zeros = s.round(s.zeros * float64(multiply))
+	s.sum *= float64(multiply)
+	s.fixStats()
+}
+
+// Count returns the total weight of inserted values.
+func (s *DDLog) Count() float64 {
+	return s.neg.sum() + s.zeros + s.pos.sum()
+}
+
+// Sum returns the weighted sum of inserted values.
+func (s *DDLog) Sum() float64 {
+	return s.sum
+}
+
+// Mean returns the weighted mean of inserted values.
+func (s *DDLog) Mean() float64 {
+	c := s.Count()
+	if c == 0 {
+		return 0
+	}
+
+	return s.sum / c
+}
+
+// Min returns the exact minimum of inserted values.
+// It's zero for empty sketch.
+func (s *DDLog) Min() float64 {
+	if s.Count() == 0 {
+		return 0
+	}
+
+	return s.min
+}
+
+// Max returns the exact maximum of inserted values.
+// It's zero for empty sketch.
+func (s *DDLog) Max() float64 {
+	if s.Count() == 0 {
+		return 0
+	}
+
+	return s.max
+}
+
+func (s *DDLog) observe(lo, hi, sum float64) {
+	if !(lo >= s.min && hi <= s.max) { // NaN aware min and max are slower than the check
+		s.min = min(s.min, lo)
+		s.max = max(s.max, hi)
+	}
+
+	s.sum += sum
+}
+
+// observeBin updates stats with bin bounds and representative value
+// for data coming without them.
+func (s *DDLog) observeBin(m IndexMapping, key int, w float64, neg bool) {
+	lo, hi, v := m.LowerBound(key), m.LowerBound(key+1), m.Value(key)
+
+	if neg {
+		lo, hi, v = -hi, -lo, -v
+	}
+
+	s.observe(lo, hi, v*w)
+}
+
+// estimateStats sets stats from the bins for data decoded from formats not keeping them.
+func (s *DDLog) estimateStats() {
+	s.resetStats()
+
+	if s.zeros != 0 {
+		s.observe(0, 0, 0)
+	}
+
+	s.pos.each(func(key int, w float64) { s.observeBin(s.m, key, w, false) })
+	s.neg.each(func(key int, w float64) { s.observeBin(s.m, key, w, true) })
+}
+
+// fixStats resets stats if s became empty.
+func (s *DDLog) fixStats() {
+	if s.Count() == 0 {
+		s.resetStats()
+	}
+}
+
+func (s *DDLog) resetStats() {
+	s.min, s.max, s.sum = math.Inf(1), math.Inf(-1), 0
+}
+
+// bin returns the storage and the key v belongs to.
+// nil storage means zero bucket.
+func (s *DDLog) bin(v float64) (ddstore, int) {
+	b := s.pos
+
+	if v < 0 {
+		v = -v
+		b = s.neg
+	}
+
+	if v < s.minPossible {
+		return nil, 0
+	}
+
+	return b, s.key(v)
+}
+
+// holds reports whether v belongs to the key bin of b.
+func (s *DDLog) holds(b ddstore, key int, v float64) bool {
+	vb, vkey := s.bin(v)
+
+	return vb == b && (b == nil || vkey == key)
+}
+
+func (s *DDLog) round(w float64) float64 {
+	if s.integer {
+		return math.Round(w)
+	}
+
+	return w
+}
+
+func newDDStore(st DDStore) ddstore {
+	switch st {
+	case DDDense | DDFloat32:
+		return &ddstorage[float32]{}
+	case DDDense | DDFloat64:
+		return &ddstorage[float64]{}
+	case DDDense | DDUint64:
+		return &ddstorage[uint64]{}
+	case DDSparse | DDFloat32:
+		return &ddsparse[float32]{}
+	case DDSparse | DDFloat64:
+		return &ddsparse[float64]{}
+	case DDSparse | DDUint64:
+		return &ddsparse[uint64]{}
 	default:
+		panic(st)
+	}
+}
+
+// ddround converts weight to T rounding it for integer counts.
+func ddround[T ddcount](w float64) T {
+	var x T
+
+	if _, ok := any(x).(uint64); ok {
+		return T(math.Round(w))
+	}
+
+	return T(w)
+}
+
+func ddkind[T ddcount](kind DDStore) DDStore {
+	var x T
+
+	switch any(x).(type) {
+	case float64:
+		return kind | DDFloat64
+	case uint64:
+		return kind | DDUint64
+	default:
+		return kind | DDFloat32
+	}
+}
+
+func ddinsert(b ddstore, key int, w float64, limit int, mode DDCollapse) (collapsed bool) {
+	if limit > 0 {
+		var lo, hi int
+
+		lo, hi, collapsed = ddfit(b, key, key, limit, mode)
+		key = min(max(key, lo), hi)
+	}
+
+	b.add(key, w, limit)
+
+	return collapsed
+}
+
+func ddmerge(b, b1 ddstore, w float64, limit int, mode DDCollapse) (collapsed bool) {
+	lo, hi, ok := b1.bounds()
+	if !ok || w == 0 {
+		return false
+	}
+
+	if w < 0 {
+		b1.each(func(key int, x float64) {
+			ddremove(b, key, -x*w, mode)
+		})
+
+		return false
+	}
+
+	if limit > 0 {
+		lo, hi, collapsed = ddfit(b, lo, hi, limit, mode)
+	}
+
+	b.reserve(lo, hi, limit)
+
+	b1.each(func(key int, x float64) {
+		key = min(max(key, lo), hi)
+
+		b.add(key, x*w, limit)
+	})
+
+	if ckey, ok := b1.collapsedKey(); ok {
+		b.markCollapsed(min(max(ckey, lo), hi))
+		collapsed = true
+	}
+
+	return collapsed
+}
+
+func ddremove(b ddstore, key int, w float64, mode DDCollapse) float64 {
+	if ckey, ok := b.collapsedKey(); ok {
+		if mode == CollapseHighest {
+			key = min(key, ckey)
+		} else {
+			key = max(key, ckey)
+		}
+	}
+
+	return b.sub(key, w)
+}
+
+// ddcheck checks that data with [lo, hi] keys range from outside can be added to st.
+// Keys must be indexable with m, and the dense store must not grow
+// over binMaxAlloc bins unless limit keeps it collapsed.
+func ddcheck(st ddstore, m IndexMapping, lo, hi, limit int) error {
+	if lo < m.Index(m.MinIndexable()) || hi > m.Index(m.MaxIndexable()) {
+		return ErrMalformed
+	}
+
+	if limit > 0 || st.kind()&ddKindMask != DDDense {
+		return nil
+	}
+
+	if blo, bhi, ok := st.bounds(); ok {
+		lo, hi = min(lo, blo), max(hi, bhi)
+	}
+
+	if hi-lo >= binMaxAlloc {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// ddfit collapses bins so that [lo, hi] keys range could be added
+// without exceeding limit bins.
+// It returns the range keys must be clamped to.
+func ddfit(b ddstore, lo, hi, limit int, mode DDCollapse) (clo, chi int, collapsed bool) {
+	l, h := lo, hi
+
+	if blo, bhi, ok := b.bounds(); ok {
+		l = min(l, blo)
+		h = max(h, bhi)
+	}
+
+	if h-l < limit {
+		return lo, hi, false
+	}
+
+	var key int
+
+	if mode == CollapseHighest {
+		h = l + limit - 1
+		key = h
+
+		collapsed = b.foldAbove(h) || hi > h
+	} else {
+		l = h - limit + 1
+		key = l
+
+		collapsed = b.foldBelow(l) || lo < l
+	}
+
+	if collapsed {
+		b.markCollapsed(key)
+	}
+
+	return min(max(lo, l), h), min(max(hi, l), h), collapsed
+}
+
+func (b *ddbase[T]) sum() float64 { return float64(b.total) }
+
+func (b *ddbase[T]) collapsedKey() (int, bool) { return b.ckey, b.collapsed }
+
+func (b *ddbase[T]) markCollapsed(key int) {
+	b.ckey = key
+	b.collapsed = true
+}
+
+func (b *ddstorage[T]) add(key int, w float64, limit int) {
+	if i := key - b.offset; i < 0 || i >= len(b.bins) {
+		b.reserve(key, key, limit)
+	}
+
+	x := ddround[T](w)
+
+	b.bins[key-b.offset] += x
+	b.total += x
+}
+
+func (b *ddstorage[T]) sub(key int, w float64) float64 {
+	i := key - b.offset
+	if i < 0 || i >= len(b.bins) {
 		return 0
 	}
 
+	x := min(ddround[T](w), b.bins[i])
+
+	b.bins[i] -= x
+	b.total -= min(x, b.total)
+
+	return float64(x)
+}
+
+func (b *ddstorage[T]) bounds() (lo, hi int, ok bool) {
+	i, j := 0, len(b.bins)-1
+
+	for i <= j && b.bins[i] == 0 {
+		i++
+	}
+
+	for i <= j && b.bins[j] == 0 {
+		j--
+	}
+
+	return b.offset + i, b.offset + j, i <= j
+}
+
+func (b *ddstorage[T]) find(limit float64, eq bool) int {
 	var cum float64
 	i := 0
 
-	for i < len(b.bins) {
+	for i < len(b.bins)-1 {
 		cum += float64(b.bins[i])
-		if cum > limit {
+		if cum > limit || eq && cum == limit {
 			break
 		}
 
 		i++
 	}
 
-	v := s.unkey(b.offset + i)
+	return b.offset + i
+}
 
-	//	log.Printf("got index %3d + %3d of %3d  with cum %.3f of %.3f   v %9.3f", b.offset, i, len(b.bins), cum, limit, v)
+func (b *ddstorage[T]) rank(key int) (below, w float64) {
+	i := key - b.offset
 
-	if b == &s.neg {
-		v = -v
+	for _, x := range b.bins[:min(max(i, 0), len(b.bins))] {
+		below += float64(x)
 	}
 
-	return v
+	if i >= 0 && i < len(b.bins) {
+		w = float64(b.bins[i])
+	}
+
+	return below, w
 }
 
-func (s *DDLog) Insert(v float64) {
-	s.InsertWeight(v, 1)
+func (b *ddstorage[T]) nextBin(i int) (key int, w float64, next int, ok bool) {
+	for ; i < len(b.bins); i++ {
+		if b.bins[i] != 0 {
+			return b.offset + i, float64(b.bins[i]), i + 1, true
+		}
+	}
+
+	return 0, 0, i, false
 }
 
-func (s *DDLog) InsertWeight(v float64, w float32) {
-	b := &s.pos
+func (b *ddstorage[T]) each(f func(key int, w float64)) {
+	for i, w := range b.bins {
+		if w == 0 {
+			continue
+		}
 
-	if v < 0 {
-		v = -v
-		b = &s.neg
+		f(b.offset+i, float64(w))
 	}
+}
 
-	if v < s.minPossible {
-		s.zeros += float64(w)
-		return
+// foldBelow adds all bins below l to l bin.
+// It reports whether any non-zero bin was folded.
+func (b *ddstorage[T]) foldBelow(l int) bool {
+	if len(b.bins) == 0 || l <= b.offset {
+		return false
+	}
+
+	d := min(l-b.offset, len(b.bins))
+
+	var sum T
+
+	for _, x := range b.bins[:d] {
+		sum += x
+	}
+
+	n := copy(b.bins, b.bins[d:])
+	clear(b.bins[n:])
+
+	b.bins = b.bins[:max(n, 1)]
+	b.bins[0] += sum
+	b.offset = l
+
+	return sum != 0
+}
+
+// foldAbove adds all bins above h to h bin.
+// It reports whether any non-zero bin was folded.
+func (b *ddstorage[T]) foldAbove(h int) bool {
+	if len(b.bins) == 0 || h >= b.offset+len(b.bins)-1 {
+		return false
 	}
 
-	key := s.key(v)
+	if h < b.offset {
+		folded := b.foldBelow(b.offset + len(b.bins))
+		b.offset = h
+
+		return folded
+	}
 
-	//	log.Printf("insert %.3v  key %d  off %d  bins %d", v, key, b.offset, len(b.bins))
+	d := h - b.offset + 1
+
+	var sum T
+
+	for _, x := range b.bins[d:] {
+		sum += x
+	}
 
+	clear(b.bins[d:])
+
+	b.bins = b.bins[:d]
+	b.bins[d-1] += sum
+
+	return sum != 0
+}
+
+func (b *ddstorage[T]) adjust(multiply float64) {
+	b.total = 0
+
+	for i, x := range b.bins {
+		b.bins[i] = ddround[T](float64(x) * multiply)
+		b.total += b.bins[i]
+	}
+}
+
+// reserve makes bins to cover [lo, hi] keys range.
+func (b *ddstorage[T]) reserve(lo, hi, limit int) {
 	if len(b.bins) == 0 {
-		b.offset = key
+		b.offset = lo
 	}
-	if key < b.offset {
-		low := key &^ 0x7
+	if lo < b.offset {
+		low := lo &^ 0x7
+
+		if limit > 0 {
+			low = lo
+		}
+
+		d := b.offset - low
+
+		if len(b.bins)+d <= cap(b.bins) {
+			b.bins = b.bins[:len(b.bins)+d]
+			copy(b.bins[d:], b.bins)
+			clear(b.bins[:d])
+		} else {
+			b.bins = append(make([]T, d, d+cap(b.bins)), b.bins...)
+		}
 
-		b.bins = append(make([]float32, b.offset-low), b.bins...)
 		b.offset = low
 	}
-	if key >= b.offset+cap(b.bins) {
+	if hi >= b.offset+cap(b.bins) {
 		end := b.offset + cap(b.bins)
 
-		b.bins = append(b.bins[:cap(b.bins)], make([]float32, key-end+1)...)
+		b.bins = append(b.bins[:cap(b.bins)], make([]T, hi-end+1)...)
 	}
-	if key >= b.offset+len(b.bins) {
-		b.bins = b.bins[:key-b.offset+1]
+	if hi >= b.offset+len(b.bins) {
+		b.bins = b.bins[:hi-b.offset+1]
 	}
+}
 
-	b.bins[key-b.offset] += w
-	b.total += float64(w)
+func (b *ddstorage[T]) reset(shrink int) {
+	if shrink > 0 && cap(b.bins) > shrink {
+		b.bins = nil
+	}
+
+	clear(b.bins)
+
+	b.bins = b.bins[:0]
+	b.offset = 0
+	b.ddbase = ddbase[T]{}
 }
 
+func (b *ddstorage[T]) kind() DDStore { return ddkind[T](DDDense) }
+
+func (b *ddstorage[T]) size() int { return cap(b.bins) * int(unsafe.Sizeof(T(0))) }
+
+// key and unkey call the default mapping directly, so it's inlined.
 func (s *DDLog) key(v float64) int {
-	return int(math.Log(v) * s.multiplier)
+	if m, ok := s.m.(LogMapping); ok {
+		return m.Index(v)
+	}
+
+	return s.m.Index(v)
 }
 
 func (s *DDLog) unkey(key int) float64 {
-	return math.Exp(float64(key) / s.multiplier)
+	if m, ok := s.m.(LogMapping); ok {
+		return m.LowerBound(key)
+	}
+
+	return s.m.LowerBound(key)
 }
 
 func (s *DDLog) dump() string {
 	var b strings.Builder
 
-	fmt.Fprintf(&b, "dd totals (neg+zero+pos): %.2f + %.2f + %.2f\n", s.neg.total, s.zeros, s.pos.total)
+	fmt.Fprintf(&b, "dd totals (neg+zero+pos): %.2f + %.2f + %.2f\n", s.neg.sum(), s.zeros, s.pos.sum())
 
-	if s.neg.total != 0 {
-		fmt.Fprintf(&b, "negative (off %3d)\n", s.neg.offset)
-		s.dumpBins(&b, &s.neg)
+	if lo, _, ok := s.neg.bounds(); ok {
+		fmt.Fprintf(&b, "negative (off %3d)\n", lo)
+		s.dumpBins(&b, s.neg)
 	}
-	if s.pos.total != 0 {
-		fmt.Fprintf(&b, "positive (off %3d)\n", s.pos.offset)
-		s.dumpBins(&b, &s.pos)
+	if lo, _, ok := s.pos.bounds(); ok {
+		fmt.Fprintf(&b, "positive (off %3d)\n", lo)
+		s.dumpBins(&b, s.pos)
 	}
 
 	return b.String()
 }
 
-func (s *DDLog) dumpBins(w io.Writer, b *ddstorage) {
-	for i, wg := range b.bins {
-		if wg == 0 {
-			continue
-		}
-
-		fmt.Fprintf(w, "i %3d  v %.3f  w %.1f\n", b.offset+i, s.unkey(b.offset+i), wg)
-	}
+func (s *DDLog) dumpBins(w io.Writer, b ddstore) {
+	b.each(func(key int, wg float64) {
+		fmt.Fprintf(w, "i %3d  v %.3f  w %.1f\n", key, s.unkey(key), wg)
+	})
 }
@@ -0,0 +1,153 @@
+package quantile
+
+import "math"
+
+// Downscale merges each 2^factor adjacent bins together
+// making gamma 2^factor times bigger in log space.
+// Relative accuracy becomes about 2^factor times worse
+// and the number of bins is 2^factor times smaller.
+//
+// Downscale is lossless in the sense that the result is the same
+// as if values were inserted into the coarser sketch in the first place.
+// It's supported for the mappings with the zero normalized index offset,
+// which is the default for all the mappings in the package.
+func (s *DDLog) Downscale(factor int) error {
+	if factor < 0 {
+		panic(factor)
+	}
+
+	if factor == 0 {
+		return nil
+	}
+
+	m, ok := ddDownscaledMapping(s.m, factor)
+	if !ok {
+		return ErrUnsupportedMapping
+	}
+
+	s.downscale(factor, m)
+
+	return nil
+}
+
+func (s *DDLog) downscale(factor int, m IndexMapping) {
+	s.pos = ddrebucket(s.pos, factor)
+	s.neg = ddrebucket(s.neg, factor)
+
+	s.m = m
+	s.minPossible = m.MinIndexable()
+	s.maxPossible = m.MaxIndexable()
+}
+
+// downscaled returns s data downscaled by factor to mapping m.
+// s is not modified.
+func (s *DDLog) downscaled(factor int, m IndexMapping) *DDLog {
+	return &DDLog{
+		pos:     ddrebucket(s.pos, factor),
+		neg:     ddrebucket(s.neg, factor),
+		zeros:   s.zeros,
+		integer: s.integer,
+
+		min: s.min,
+		max: s.max,
+		sum: s.sum,
+
+		m:           m,
+		minPossible: m.MinIndexable(),
+		maxPossible: m.MaxIndexable(),
+	}
+}
+
+// ddrebucket returns a new store of the same kind with keys shifted right by factor bits.
+func ddrebucket(b ddstore, factor int) ddstore {
+	r := newDDStore(b.kind())
+
+	if lo, hi, ok := b.bounds(); ok {
+		r.reserve(lo>>factor, hi>>factor, 0)
+	}
+
+	b.each(func(key int, w float64) {
+		r.add(key>>factor, w, 0)
+	})
+
+	if ckey, ok := b.collapsedKey(); ok {
+		r.markCollapsed(ckey >> factor)
+	}
+
+	return r
+}
+
+// ddScaleDiff returns factor f such that b mapping is a mapping downscaled by f.
+// Negative f means a is coarser than b.
+func ddScaleDiff(a, b IndexMapping) (int, bool) {
+	var ma, mb float64
+
+	switch a := a.(type) {
+	case LogMapping:
+		b, ok := b.(LogMapping)
+		if !ok || a.offset != 0 || b.offset != 0 {
+			return 0, false
+		}
+
+		ma, mb = a.multiplier, b.multiplier
+	case LinearMapping:
+		b, ok := b.(LinearMapping)
+		if !ok || a.norm != 0 || b.norm != 0 {
+			return 0, false
+		}
+
+		ma, mb = a.multiplier, b.multiplier
+	case CubicMapping:
+		b, ok := b.(CubicMapping)
+		if !ok || a.norm != 0 || b.norm != 0 {
+			return 0, false
+		}
+
+		ma, mb = a.multiplier, b.multiplier
+	default:
+		return 0, false
+	}
+
+	f := math.Round(math.Log2(ma / mb))
+
+	if math.Abs(ma/mb/math.Exp2(f)-1) > 1e-9 {
+		return 0, false
+	}
+
+	return int(f), true
+}
+
+func ddDownscaledMapping(m IndexMapping, factor int) (IndexMapping, bool) {
+	if scale, ok := expScale(m); ok {
+		return expMapping(scale - int32(factor)), true
+	}
+
+	switch m := m.(type) {
+	case LogMapping:
+		if m.offset != 0 {
+			return nil, false
+		}
+
+		return NewLogMappingGamma(ddDownscaledGamma(m.gamma, factor), 0), true
+	case LinearMapping:
+		if m.norm != 0 {
+			return nil, false
+		}
+
+		gamma := ddDownscaledGamma(m.gamma, factor)
+
+		return NewLinearMappingGamma(gamma, 1/math.Log2(gamma)), true
+	case CubicMapping:
+		if m.norm != 0 {
+			return nil, false
+		}
+
+		return NewCubicMappingGamma(ddDownscaledGamma(m.gamma, factor), 0), true
+	default:
+		return nil, false
+	}
+}
+
+func ddDownscaledGamma(gamma float64, factor int) float64 {
+	return math.Exp2(math.Log2(gamma) * math.Exp2(float64(factor)))
+}
@@ -0,0 +1,146 @@
+package quantile
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestDDDownscale(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogPrometheus(5, st)
+		exp := NewDDLogPrometheus(2, DDDense)
+
+		for range 1000 {
+			v := r.NormFloat64() * 100
+
+			s.Insert(v)
+			exp.Insert(v)
+		}
+
+		err := s.Downscale(3)
+		if err != nil {
+			tb.Fatalf("downscale: %v", err)
+		}
+
+		if s.m != exp.m {
+			tb.Errorf("mapping %+v  wanted %+v", s.m, exp.m)
+		}
+
+		assertDDEqual(tb, s, exp)
+	}
+}
+
+func TestDDDownscaleMappings(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, m := range []IndexMapping{NewLogMapping(0.001), NewLinearMapping(0.001), NewCubicMapping(0.001)} {
+		e := NewExact()
+		s := NewDDLogMapping(m, DDDense)
+
+		for range 1000 {
+			v := math.Exp(r.NormFloat64() * 5)
+
+			e.Insert(v)
+			s.Insert(v)
+		}
+
+		err := s.Downscale(4)
+		if err != nil {
+			tb.Fatalf("downscale: %v", err)
+		}
+
+		acc := s.m.RelativeAccuracy()
+
+		if acc < 0.001*15 || acc > 0.001*17 {
+			tb.Errorf("%T: accuracy %v", m, acc)
+		}
+
+		for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+			x, y := s.Query(q), e.Query(q)
+
+			if math.Abs(x-y)/y > 2*acc {
+				tb.Errorf("%T: q %.2f => %v  wanted %v", m, q, x, y)
+			}
+		}
+	}
+
+	err := NewDDLogMapping(NewLogMappingGamma(1.01, 0.5), DDDense).Downscale(1)
+	if err != ErrUnsupportedMapping {
+		tb.Errorf("expected unsupported mapping, got %v", err)
+	}
+}
+
+func TestDDMergeDownscale(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	fine := NewDDLog(0.01)
+	coarse := NewDDLog(0.01)
+
+	err := coarse.Downscale(2)
+	if err != nil {
+		tb.Fatalf("downscale: %v", err)
+	}
+
+	all := NewDDLog(0.01)
+
+	for i := range 1000 {
+		v := r.NormFloat64() * 100
+
+		all.Insert(v)
+
+		if i%2 == 0 {
+			fine.Insert(v)
+		} else {
+			coarse.Insert(v)
+		}
+	}
+
+	err = all.Downscale(2)
+	if err != nil {
+		tb.Fatalf("downscale: %v", err)
+	}
+
+	a := NewDDLog(0.01)
+
+	err = a.Merge(fine)
+	if err != nil {
+		tb.Fatalf("merge: %v", err)
+	}
+
+	err = a.Merge(coarse)
+	if err != nil {
+		tb.Fatalf("merge coarse into fine: %v", err)
+	}
+
+	assertDDEqual(tb, a, all)
+
+	b := NewDDLog(0.01)
+	_ = b.Downscale(2)
+
+	err = b.Merge(coarse)
+	if err != nil {
+		tb.Fatalf("merge: %v", err)
+	}
+
+	err = b.Merge(fine)
+	if err != nil {
+		tb.Fatalf("merge fine into coarse: %v", err)
+	}
+
+	assertDDEqual(tb, b, all)
+
+	if fine.m != NewLogMapping(0.01) {
+		tb.Errorf("merge argument was modified")
+	}
+
+	err = a.Merge(NewDDLog(0.015))
+	if err != ErrMappingMismatch {
+		tb.Errorf("expected mapping mismatch, got %v", err)
+	}
+}
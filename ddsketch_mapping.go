@@ -0,0 +1,280 @@
+package quantile
+
+// Based on DataDog implementation.
+//
+// https://github.com/DataDog/sketches-go/tree/master/ddsketch/mapping
+
+import "math"
+
+type (
+	// IndexMapping maps positive values to bin indexes and back.
+	//
+	// Mappings are comparable values, sketches can only be merged
+	// if their mappings are equal.
+	IndexMapping interface {
+		// Index returns the index of the bin v belongs to.
+		Index(v float64) int
+
+		// LowerBound returns the lowest value of index bin.
+		LowerBound(index int) float64
+
+		// Value returns the bin value representative
+		// which is within relative accuracy from any value in the bin.
+		Value(index int) float64
+
+		RelativeAccuracy() float64
+
+		// MinIndexable and MaxIndexable are the bounds of the values range
+		// the mapping can index.
+		MinIndexable() float64
+		MaxIndexable() float64
+	}
+
+	// LogMapping is a memory optimal mapping.
+	// Bins bounds are powers of gamma.
+	// It works in log2 space so powers of two are exact bins bounds if gamma allows.
+	LogMapping struct {
+		gamma, offset float64
+
+		multiplier float64
+	}
+
+	// LinearMapping approximates the logarithm by the float64 exponent
+	// and linearly interpolated significand.
+	// It's faster than LogMapping at the cost of about 44% more bins.
+	LinearMapping struct {
+		gamma, offset float64
+
+		multiplier, norm float64
+	}
+
+	// CubicMapping approximates the logarithm by the float64 exponent
+	// and cubically interpolated significand.
+	// It's faster than LogMapping at the cost of about 1% more bins.
+	CubicMapping struct {
+		gamma, offset float64
+
+		multiplier, norm float64
+	}
+)
+
+// Cubic interpolation coefficients.
+const (
+	cubicA = 6.0 / 35
+	cubicB = -3.0 / 5
+	cubicC = 10.0 / 7
+)
+
+const (
+	float64SignificandMask = 1<<52 - 1
+	float64ExponentBias    = 1023
+	float64MinNormal       = 0x1p-1022
+)
+
+func NewLogMapping(relAcc float64) LogMapping {
+	gamma := (1 + relAcc) / (1 - relAcc)
+
+	return NewLogMappingGamma(gamma, 0)
+}
+
+// NewLogMappingGamma creates a mapping where value v is mapped to floor(log_gamma(v) + offset).
+func NewLogMappingGamma(gamma, offset float64) LogMapping {
+	return LogMapping{
+		gamma:      gamma,
+		offset:     offset,
+		multiplier: 1 / math.Log2(gamma),
+	}
+}
+
+func (m LogMapping) Index(v float64) int {
+	return int(math.Floor(ddLog2(v)*m.multiplier + m.offset))
+}
+
+func (m LogMapping) LowerBound(index int) float64 {
+	return math.Exp2((float64(index) - m.offset) / m.multiplier)
+}
+
+func (m LogMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m LogMapping) RelativeAccuracy() float64 {
+	return (m.gamma - 1) / (m.gamma + 1)
+}
+
+func (m LogMapping) MinIndexable() float64 {
+	return float64MinNormal * m.gamma
+}
+
+func (m LogMapping) MaxIndexable() float64 {
+	return math.MaxFloat64 / m.gamma
+}
+
+func NewLinearMapping(relAcc float64) LinearMapping {
+	gamma := math.Pow((1+relAcc)/(1-relAcc), math.Ln2)
+
+	return NewLinearMappingGamma(gamma, 1/math.Log2(gamma)) // DataDog compatible offset
+}
+
+func NewLinearMappingGamma(gamma, offset float64) LinearMapping {
+	multiplier := 1 / math.Log2(gamma)
+
+	return LinearMapping{
+		gamma:  gamma,
+		offset: offset,
+
+		multiplier: multiplier,
+		norm:       offset - multiplier, // offset - approxLog(1) * multiplier
+	}
+}
+
+func (m LinearMapping) Index(v float64) int {
+	return int(math.Floor(m.approxLog(v)*m.multiplier + m.norm))
+}
+
+func (m LinearMapping) LowerBound(index int) float64 {
+	return m.approxInvLog((float64(index) - m.norm) / m.multiplier)
+}
+
+func (m LinearMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m LinearMapping) RelativeAccuracy() float64 {
+	return 1 - 2/(1+math.Exp(math.Log2(m.gamma)))
+}
+
+func (m LinearMapping) MinIndexable() float64 {
+	return 2 * float64MinNormal // so that the lowest bin bound is normal too
+}
+
+func (m LinearMapping) MaxIndexable() float64 {
+	return math.MaxFloat64 / (1 + m.RelativeAccuracy())
+}
+
+// approxLog approximates log2(v) + 1.
+func (m LinearMapping) approxLog(v float64) float64 {
+	bits := math.Float64bits(v)
+
+	return float64Exponent(bits) + float64Significand(bits)
+}
+
+// approxInvLog is the exact inverse of approxLog.
+func (m LinearMapping) approxInvLog(x float64) float64 {
+	exp := math.Floor(x - 1)
+
+	return buildFloat64(int(exp), x-exp)
+}
+
+func NewCubicMapping(relAcc float64) CubicMapping {
+	gamma := math.Pow((1+relAcc)/(1-relAcc), 10*math.Ln2/7)
+
+	return NewCubicMappingGamma(gamma, 0)
+}
+
+func NewCubicMappingGamma(gamma, offset float64) CubicMapping {
+	return CubicMapping{
+		gamma:  gamma,
+		offset: offset,
+
+		multiplier: 1 / math.Log2(gamma),
+		norm:       offset, // offset - approxLog(1) * multiplier
+	}
+}
+
+func (m CubicMapping) Index(v float64) int {
+	return int(math.Floor(m.approxLog(v)*m.multiplier + m.norm))
+}
+
+func (m CubicMapping) LowerBound(index int) float64 {
+	return m.approxInvLog((float64(index) - m.norm) / m.multiplier)
+}
+
+func (m CubicMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m CubicMapping) RelativeAccuracy() float64 {
+	return 1 - 2/(1+math.Exp(7.0/10*math.Log2(m.gamma)))
+}
+
+func (m CubicMapping) MinIndexable() float64 {
+	return 2 * float64MinNormal // so that the lowest bin bound is normal too
+}
+
+func (m CubicMapping) MaxIndexable() float64 {
+	return math.MaxFloat64 / (1 + m.RelativeAccuracy())
+}
+
+// approxLog approximates log2(v).
+func (m CubicMapping) approxLog(v float64) float64 {
+	bits := math.Float64bits(v)
+	s := float64Significand(bits) - 1
+
+	return float64Exponent(bits) + ((cubicA*s+cubicB)*s+cubicC)*s
+}
+
+// approxInvLog is the exact inverse of approxLog.
+// It's derived from Cardano's formula.
+func (m CubicMapping) approxInvLog(x float64) float64 {
+	exp := math.Floor(x)
+
+	d0 := cubicB*cubicB - 3*cubicA*cubicC
+	d1 := 2*cubicB*cubicB*cubicB - 9*cubicA*cubicB*cubicC - 27*cubicA*cubicA*(x-exp)
+	p := math.Cbrt((d1 - math.Sqrt(d1*d1-4*d0*d0*d0)) / 2)
+
+	s := -(cubicB+p+d0/p)/(3*cubicA) + 1
+
+	return buildFloat64(int(exp), s)
+}
+
+// float64Exponent returns unbiased v exponent.
+func float64Exponent(bits uint64) float64 {
+	return float64(int(bits>>52&0x7ff) - float64ExponentBias)
+}
+
+// float64Significand returns v significand in [1, 2) range.
+func float64Significand(bits uint64) float64 {
+	return math.Float64frombits(bits&float64SignificandMask | float64ExponentBias<<52)
+}
+
+func buildFloat64(exp int, significand float64) float64 {
+	return math.Float64frombits(uint64(exp+float64ExponentBias)<<52 | math.Float64bits(significand)&float64SignificandMask)
+}
+
+// ddLog2 is math.Log2 for positive normal v, but faster.
+// It's the core of math.Log with the argument reduced by float64 bits
+// to the significand in [sqrt(2)/2, sqrt(2)) without branches,
+// so powers of two are exact.
+func ddLog2(v float64) float64 {
+	const (
+		L1 = 6.666666666666735130e-01
+		L2 = 3.999999999940941908e-01
+		L3 = 2.857142874366239149e-01
+		L4 = 2.222219843214978396e-01
+		L5 = 1.818357216161805012e-01
+		L6 = 1.531383769920937332e-01
+		L7 = 1.479819860511658591e-01
+
+		sqrt2half = 0x3fe6a09e667f3bcd // math.Sqrt2 / 2 bits
+	)
+
+	x := math.Float64bits(v)
+
+	if x-1<<52 >= 0x7fe<<52 {
+		return math.Log2(v) // zero, subnormal, negative, Inf or NaN
+	}
+
+	t := x - sqrt2half
+	exp := int64(t) >> 52
+	f := math.Float64frombits(x-t&(0xfff<<52)) - 1
+
+	s := f / (2 + f)
+	s2 := s * s
+	s4 := s2 * s2
+	t1 := s2 * (L1 + s4*(L3+s4*(L5+s4*L7)))
+	t2 := s4 * (L2 + s4*(L4+s4*L6))
+	hfsq := 0.5 * f * f
+
+	return float64(exp) + (f-(hfsq-s*(hfsq+t1+t2)))*(1/math.Ln2)
+}
@@ -0,0 +1,98 @@
+package quantile
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestIndexMappings(tb *testing.T) {
+	for _, relAcc := range []float64{0.1, 0.01, 0.001} {
+		for _, m := range []IndexMapping{NewLogMapping(relAcc), NewLinearMapping(relAcc), NewCubicMapping(relAcc)} {
+			tb.Run(fmt.Sprintf("%T_%v", m, relAcc), func(tb *testing.T) {
+				if a := m.RelativeAccuracy(); math.Abs(a-relAcc) > 1e-9 {
+					tb.Errorf("relative accuracy %v  wanted %v", a, relAcc)
+				}
+
+				src := rand.NewChaCha8([32]byte{})
+				r := rand.New(src)
+
+				for range 100000 {
+					v := math.Exp(r.NormFloat64() * 100)
+					if v < m.MinIndexable() || v > m.MaxIndexable() {
+						continue
+					}
+
+					testIndexMapping(tb, m, relAcc, v)
+				}
+
+				for _, v := range []float64{1, 2, 0.5, 3, 1e-300, 1e300, m.MinIndexable(), m.MaxIndexable()} {
+					testIndexMapping(tb, m, relAcc, v)
+				}
+			})
+		}
+	}
+}
+
+func TestDDLog2(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	m := NewLogMapping(0.01)
+
+	for i := range 1000000 {
+		v := math.Exp(r.NormFloat64() * 100)
+		if i%2 == 0 {
+			v = r.Float64()
+		}
+
+		if x, want := ddLog2(v), math.Log2(v); math.Abs(x-want) > 1e-14*max(1, math.Abs(want)) {
+			tb.Fatalf("log2(%v) = %v, want %v", v, x, want)
+		}
+
+		if x, want := m.Index(v), int(math.Floor(math.Log2(v)*m.multiplier+m.offset)); x != want {
+			tb.Fatalf("index(%v) = %d, want %d", v, x, want)
+		}
+	}
+
+	for e := -1074; e <= 1023; e++ {
+		v := math.Ldexp(1, e)
+
+		if x := ddLog2(v); x != float64(e) {
+			tb.Fatalf("log2(%v) = %v, want %v", v, x, e)
+		}
+	}
+
+	for _, v := range []float64{0, math.Inf(1), math.NaN(), -1, math.MaxFloat64, math.SmallestNonzeroFloat64} {
+		if x, want := ddLog2(v), math.Log2(v); x != want && !(math.IsNaN(x) && math.IsNaN(want)) {
+			tb.Errorf("log2(%v) = %v, want %v", v, x, want)
+		}
+	}
+}
+
+func testIndexMapping(tb *testing.T, m IndexMapping, relAcc, v float64) {
+	tb.Helper()
+
+	i := m.Index(v)
+	lo, hi := m.LowerBound(i), m.LowerBound(i+1)
+	x := m.Value(i)
+
+	if v < lo*(1-1e-12) || v >= hi*(1+1e-12) {
+		tb.Fatalf("value %v  index %d  out of bounds [%v, %v)", v, i, lo, hi)
+	}
+
+	if d := math.Abs(x-v) / v; d > relAcc*(1+1e-9) {
+		tb.Fatalf("value %v  index %d  representative %v  rel error %v > %v", v, i, x, d, relAcc)
+	}
+}
+
+func BenchmarkIndexMapping(tb *testing.B) {
+	for _, m := range []IndexMapping{NewLogMapping(0.01), NewLinearMapping(0.01), NewCubicMapping(0.01)} {
+		tb.Run(fmt.Sprintf("%T", m), func(tb *testing.B) {
+			s := NewDDLogMapping(m, DDDense)
+
+			benchInsert(tb, s)
+		})
+	}
+}
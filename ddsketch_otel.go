@@ -0,0 +1,246 @@
+package quantile
+
+// OpenTelemetry exponential histograms.
+//
+// https://opentelemetry.io/docs/specs/otel/metrics/data-model/#exponentialhistogram
+
+import "math"
+
+type (
+	// OTelExponentialHistogram mirrors OTLP ExponentialHistogramDataPoint buckets fields.
+	//
+	// Buckets are exponential with base 2^(2^-Scale).
+	// Bucket index i covers (base^i, base^(i+1)] range.
+	OTelExponentialHistogram struct {
+		Count         uint64
+		Scale         int32
+		ZeroCount     uint64
+		ZeroThreshold float64
+
+		Positive OTelBuckets
+		Negative OTelBuckets
+	}
+
+	// OTelBuckets is a dense set of buckets.
+	// BucketCounts[i] is a count of bucket with Offset+i index.
+	OTelBuckets struct {
+		Offset       int32
+		BucketCounts []uint64
+	}
+)
+
+// OpenTelemetry scale range.
+const (
+	OTelScaleMin = -10
+	OTelScaleMax = 20
+)
+
+// NewDDLogOTel creates DDLog with buckets matching OpenTelemetry scale.
+func NewDDLogOTel(scale int32, st DDStore) *DDLog {
+	if scale < OTelScaleMin || scale > OTelScaleMax {
+		panic(scale)
+	}
+
+	return NewDDLogMapping(expMapping(scale), st)
+}
+
+// NewDDLogFromOTel creates DDLog with the same buckets as h
+// and copies its data losslessly.
+func NewDDLogFromOTel(h *OTelExponentialHistogram, st DDStore) (*DDLog, error) {
+	if h.Scale < OTelScaleMin || h.Scale > OTelScaleMax {
+		return nil, ErrSchemaMismatch
+	}
+
+	s := NewDDLogOTel(h.Scale, st)
+
+	err := s.InsertOTel(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ToOTel converts s into OpenTelemetry histogram reusing h slices.
+// Bin weights are rounded to integers.
+//
+// If s was created by NewDDLogOTel or has the equivalent mapping
+// conversion is lossless except for values exactly at bucket bounds
+// which DDLog puts to the upper bucket and OpenTelemetry to the lower one.
+//
+// Otherwise conversion is lossy.
+// The scale is chosen to have the relative accuracy not better than s has,
+// and each bin is added to the bucket its representative value falls into.
+// The resulting relative error is bounded by the sum of both accuracies,
+// that is about twice the s accuracy.
+func (s *DDLog) ToOTel(h *OTelExponentialHistogram) {
+	scale, exact := expScale(s.m)
+	if !exact || scale < OTelScaleMin || scale > OTelScaleMax {
+		scale, exact = otelScale(s.m.RelativeAccuracy()), false
+	}
+
+	m := expMapping(scale)
+	zeros := uint64(math.Round(s.zeros))
+
+	*h = OTelExponentialHistogram{
+		Count:         zeros,
+		Scale:         scale,
+		ZeroCount:     zeros,
+		ZeroThreshold: s.minPossible,
+
+		Positive: OTelBuckets{BucketCounts: h.Positive.BucketCounts[:0]},
+		Negative: OTelBuckets{BucketCounts: h.Negative.BucketCounts[:0]},
+	}
+
+	key := func(k int) int { return k }
+
+	if !exact {
+		key = func(k int) int { return m.Index(s.m.Value(k)) }
+	}
+
+	h.Count += otelEncodeBuckets(&h.Positive, s.pos, key)
+	h.Count += otelEncodeBuckets(&h.Negative, s.neg, key)
+}
+
+// InsertOTel adds h buckets to s.
+//
+// If s has the mapping equivalent to h.Scale the operation is lossless.
+// Otherwise each bucket count is inserted as its representative value,
+// which adds up to h accuracy to the s relative error.
+//
+// Min, Max and Sum are updated using h buckets bounds and representatives.
+//
+// Buckets outside of the indexable range or too widely spread for the dense store
+// without MaxBins are reported as ErrMalformed and s is not changed.
+func (s *DDLog) InsertOTel(h *OTelExponentialHistogram) error {
+	if h.Scale < OTelScaleMin || h.Scale > OTelScaleMax {
+		return ErrSchemaMismatch
+	}
+
+	scale, exact := expScale(s.m)
+	exact = exact && scale == h.Scale
+
+	m := expMapping(h.Scale)
+
+	// check everything first, so bad data can't make the store allocate a lot.
+	err := s.checkOTelBuckets(s.pos, &h.Positive, m, exact)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkOTelBuckets(s.neg, &h.Negative, m, exact)
+	if err != nil {
+		return err
+	}
+
+	s.zeros += float64(h.ZeroCount)
+
+	if h.ZeroCount != 0 {
+		s.observe(0, 0, 0)
+	}
+
+	s.insertOTelBuckets(s.pos, &h.Positive, m, exact)
+	s.insertOTelBuckets(s.neg, &h.Negative, m, exact)
+
+	return nil
+}
+
+func (s *DDLog) checkOTelBuckets(b ddstore, bs *OTelBuckets, m LogMapping, exact bool) error {
+	lo, hi := -1, -1
+
+	for i, c := range bs.BucketCounts {
+		if c == 0 {
+			continue
+		}
+
+		if lo < 0 {
+			lo = i
+		}
+
+		hi = i
+	}
+
+	if lo < 0 {
+		return nil
+	}
+
+	lo, hi = int(bs.Offset)+lo, int(bs.Offset)+hi
+
+	if !exact {
+		if lo < m.Index(m.MinIndexable()) || hi > m.Index(m.MaxIndexable()) {
+			return ErrMalformed
+		}
+
+		lo, hi = s.key(m.Value(lo)), s.key(m.Value(hi))
+	}
+
+	return ddcheck(b, s.m, lo, hi, s.MaxBins)
+}
+
+func (s *DDLog) insertOTelBuckets(b ddstore, bs *OTelBuckets, m LogMapping, exact bool) {
+	for i, c := range bs.BucketCounts {
+		if c == 0 {
+			continue
+		}
+
+		key := int(bs.Offset) + i
+
+		s.observeBin(m, key, float64(c), b == s.neg)
+
+		if !exact {
+			key = s.key(m.Value(key))
+		}
+
+		if ddinsert(b, key, float64(c), s.MaxBins, s.Collapse) {
+			s.Collapses++
+		}
+	}
+}
+
+func otelEncodeBuckets(bs *OTelBuckets, b ddstore, key func(int) int) (cnt uint64) {
+	var cur float64
+	last := 0
+
+	flush := func() {
+		c := uint64(math.Round(cur))
+
+		bs.BucketCounts[last-int(bs.Offset)] += c
+		cnt += c
+		cur = 0
+	}
+
+	b.each(func(k int, w float64) {
+		idx := key(k)
+
+		switch {
+		case len(bs.BucketCounts) == 0:
+			bs.Offset = int32(idx)
+		case idx == last:
+			cur += w
+			return
+		default:
+			flush()
+		}
+
+		for int(bs.Offset)+len(bs.BucketCounts) <= idx {
+			bs.BucketCounts = append(bs.BucketCounts, 0)
+		}
+
+		last = idx
+		cur = w
+	})
+
+	if len(bs.BucketCounts) != 0 {
+		flush()
+	}
+
+	return cnt
+}
+
+// otelScale returns the finest scale with relative accuracy not better than relAcc.
+func otelScale(relAcc float64) int32 {
+	gamma := (1 + relAcc) / (1 - relAcc)
+	scale := math.Floor(-math.Log2(math.Log2(gamma)))
+
+	return int32(min(max(scale, OTelScaleMin), OTelScaleMax))
+}
@@ -0,0 +1,131 @@
+package quantile
+
+import (
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestDDOTel(tb *testing.T) {
+	s := NewDDLogOTel(0, DDSparse) // base 2
+
+	for _, v := range []float64{0, 1.5, 1.5, 3, 20, 24, -0.75} {
+		s.Insert(v)
+	}
+
+	var h OTelExponentialHistogram
+
+	s.ToOTel(&h)
+
+	exp := OTelExponentialHistogram{
+		Count:         7,
+		Scale:         0,
+		ZeroCount:     1,
+		ZeroThreshold: s.minPossible,
+
+		Positive: OTelBuckets{Offset: 0, BucketCounts: []uint64{2, 1, 0, 0, 2}}, // (1, 2], (2, 4], ... (16, 32]
+		Negative: OTelBuckets{Offset: -1, BucketCounts: []uint64{1}},            // (0.5, 1]
+	}
+
+	if !reflect.DeepEqual(h, exp) {
+		tb.Errorf("histogram\n got  %+v\n want %+v", h, exp)
+	}
+
+	d, err := NewDDLogFromOTel(&h, DDDense)
+	if err != nil {
+		tb.Fatalf("from otel: %v", err)
+	}
+
+	assertDDEqual(tb, d, s)
+}
+
+func TestDDOTelLossy(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	const relAcc = 0.01
+
+	e := NewExact()
+	s := NewDDLogMapping(NewCubicMapping(relAcc), DDDense)
+
+	for range 10000 {
+		v := math.Exp(r.NormFloat64() * 3)
+
+		e.Insert(v)
+		s.Insert(v)
+	}
+
+	var h OTelExponentialHistogram
+
+	s.ToOTel(&h)
+
+	if h.Count != 10000 {
+		tb.Errorf("count %d", h.Count)
+	}
+
+	if a := expMapping(h.Scale).RelativeAccuracy(); a < relAcc || a > 2*relAcc {
+		tb.Errorf("scale %d  accuracy %v", h.Scale, a)
+	}
+
+	// back to a sketch with yet another accuracy
+	d := NewDDLog(relAcc)
+
+	err := d.InsertOTel(&h)
+	if err != nil {
+		tb.Fatalf("insert otel: %v", err)
+	}
+
+	acc := 2*relAcc + 2*expMapping(h.Scale).RelativeAccuracy()
+
+	for _, q := range []float64{0.01, 0.1, 0.3, 0.5, 0.7, 0.9, 0.99} {
+		x, y := d.Query(q), e.Query(q)
+
+		if math.Abs(x-y)/y > acc {
+			tb.Errorf("q %.2f => %v  wanted %v  (rel err %.4f > %.4f)", q, x, y, math.Abs(x-y)/y, acc)
+		}
+	}
+}
+
+func TestOTelHostileOffset(tb *testing.T) {
+	for _, tc := range []struct {
+		off    int32
+		sparse error
+	}{
+		{math.MaxInt32 - 5, ErrMalformed},
+		{math.MinInt32, ErrMalformed},
+		{1 << 24, nil}, // a valid bucket, but too far from 1 for the dense store
+	} {
+		for _, st := range []DDStore{DDDense, DDSparse} {
+			s := NewDDLogOTel(20, st)
+			s.Insert(1)
+
+			h := OTelExponentialHistogram{
+				Scale:     20,
+				ZeroCount: 1,
+				Positive:  OTelBuckets{Offset: tc.off, BucketCounts: []uint64{1, 2}},
+			}
+
+			want := tc.sparse
+			if st == DDDense {
+				want = ErrMalformed
+			}
+
+			err := s.InsertOTel(&h)
+			if err != want {
+				tb.Errorf("store %v offset %d: %v, want %v", st, tc.off, err, want)
+			}
+
+			if err != nil && (s.Count() != 1 || s.Max() != 1) {
+				tb.Errorf("store %v offset %d: changed on error: %v", st, tc.off, s)
+			}
+		}
+	}
+
+	h := OTelExponentialHistogram{Scale: 30}
+
+	err := NewDDLogOTel(20, DDDense).InsertOTel(&h)
+	if err != ErrSchemaMismatch {
+		tb.Errorf("scale: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package quantile
+
+// Prometheus native histograms.
+//
+// https://prometheus.io/docs/specs/native_histograms/
+
+import (
+	"errors"
+	"math"
+)
+
+type (
+	// PromHistogram mirrors Prometheus native (sparse) histogram fields.
+	//
+	// Buckets are exponential with base 2^(2^-Schema).
+	// Bucket index i covers (base^(i-1), base^i] range.
+	// Deltas hold the first bucket count and then differences
+	// between each bucket count and the previous one.
+	PromHistogram struct {
+		Schema        int32
+		ZeroThreshold float64
+		ZeroCount     uint64
+		Count         uint64
+
+		PositiveSpans  []PromSpan
+		PositiveDeltas []int64
+		NegativeSpans  []PromSpan
+		NegativeDeltas []int64
+	}
+
+	// PromSpan is a sequence of Length consecutive buckets.
+	// Offset is the first bucket index for the first span
+	// and the gap from the previous span end for others.
+	PromSpan struct {
+		Offset int32
+		Length uint32
+	}
+)
+
+// Prometheus schema range.
+const (
+	PromSchemaMin = -4
+	PromSchemaMax = 8
+)
+
+var ErrSchemaMismatch = errors.New("schema mismatch")
+
+// NewDDLogPrometheus creates DDLog with buckets matching Prometheus schema.
+// Relative accuracy is (base-1)/(base+1), which is about 0.27% for schema 8
+// and 5.4% for schema 3.
+func NewDDLogPrometheus(schema int32, st DDStore) *DDLog {
+	if schema < PromSchemaMin || schema > PromSchemaMax {
+		panic(schema)
+	}
+
+	return NewDDLogMapping(expMapping(schema), st)
+}
+
+// NewDDLogFromPrometheus creates DDLog from Prometheus histogram.
+// Values from Prometheus zero bucket are added to DDLog zero bucket.
+// Min, Max and Sum are estimated from the buckets.
+func NewDDLogFromPrometheus(h *PromHistogram, st DDStore) (*DDLog, error) {
+	if h.Schema < PromSchemaMin || h.Schema > PromSchemaMax {
+		return nil, ErrSchemaMismatch
+	}
+
+	s := NewDDLogPrometheus(h.Schema, st)
+
+	s.zeros = float64(h.ZeroCount)
+
+	err := promDecodeBuckets(s.pos, s.m, h.PositiveSpans, h.PositiveDeltas)
+	if err != nil {
+		return nil, err
+	}
+
+	err = promDecodeBuckets(s.neg, s.m, h.NegativeSpans, h.NegativeDeltas)
+	if err != nil {
+		return nil, err
+	}
+
+	s.estimateStats()
+
+	return s, nil
+}
+
+// ToPrometheus converts s into Prometheus histogram reusing h slices.
+// s must be created by NewDDLogPrometheus or have the equivalent mapping.
+// Bin weights are rounded to integers.
+//
+// Conversion is lossless except for values exactly at bucket bounds
+// which DDLog puts to the upper bucket and Prometheus to the lower one.
+func (s *DDLog) ToPrometheus(h *PromHistogram) error {
+	schema, ok := expScale(s.m)
+	if !ok || schema < PromSchemaMin || schema > PromSchemaMax {
+		return ErrSchemaMismatch
+	}
+
+	zeros := uint64(math.Round(s.zeros))
+
+	*h = PromHistogram{
+		Schema:        schema,
+		ZeroThreshold: s.minPossible,
+		ZeroCount:     zeros,
+		Count:         zeros,
+
+		PositiveSpans:  h.PositiveSpans[:0],
+		PositiveDeltas: h.PositiveDeltas[:0],
+		NegativeSpans:  h.NegativeSpans[:0],
+		NegativeDeltas: h.NegativeDeltas[:0],
+	}
+
+	var cnt uint64
+
+	h.PositiveSpans, h.PositiveDeltas, cnt = promEncodeBuckets(h.PositiveSpans, h.PositiveDeltas, s.pos)
+	h.Count += cnt
+
+	h.NegativeSpans, h.NegativeDeltas, cnt = promEncodeBuckets(h.NegativeSpans, h.NegativeDeltas, s.neg)
+	h.Count += cnt
+
+	return nil
+}
+
+func promEncodeBuckets(spans []PromSpan, deltas []int64, b ddstore) (_ []PromSpan, _ []int64, cnt uint64) {
+	var prev int64
+	var next int
+
+	b.each(func(key int, w float64) {
+		c := int64(math.Round(w))
+		if c <= 0 {
+			return
+		}
+
+		idx := key + 1 // (base^(i-1), base^i] vs [gamma^k, gamma^(k+1))
+
+		switch {
+		case len(spans) == 0:
+			spans = append(spans, PromSpan{Offset: int32(idx)})
+		case idx != next:
+			spans = append(spans, PromSpan{Offset: int32(idx - next)})
+		}
+
+		spans[len(spans)-1].Length++
+		next = idx + 1
+
+		deltas = append(deltas, c-prev)
+		prev = c
+		cnt += uint64(c)
+	})
+
+	return spans, deltas, cnt
+}
+
+func promDecodeBuckets(b ddstore, m IndexMapping, spans []PromSpan, deltas []int64) error {
+	lo, hi := math.MaxInt, math.MinInt
+
+	// check everything first, so bad data can't make the store allocate a lot.
+	err := promEachBucket(spans, deltas, func(key int, c int64) {
+		lo, hi = min(lo, key), max(hi, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	if lo > hi {
+		return nil
+	}
+
+	err = ddcheck(b, m, lo, hi, 0)
+	if err != nil {
+		return err
+	}
+
+	return promEachBucket(spans, deltas, func(key int, c int64) {
+		b.add(key, float64(c), 0)
+	})
+}
+
+// promEachBucket calls f with DDLog key and count for each non-empty bucket.
+func promEachBucket(spans []PromSpan, deltas []int64, f func(key int, c int64)) error {
+	var c int64
+	var idx, i int
+
+	for j, sp := range spans {
+		if j == 0 {
+			idx = int(sp.Offset)
+		} else {
+			idx += int(sp.Offset)
+		}
+
+		for range sp.Length {
+			if i == len(deltas) {
+				return ErrMalformed
+			}
+
+			c += deltas[i]
+			i++
+
+			if c < 0 {
+				return ErrMalformed
+			}
+			if c != 0 {
+				f(idx-1, c) // (base^(i-1), base^i] vs [gamma^k, gamma^(k+1))
+			}
+
+			idx++
+		}
+	}
+
+	if i != len(deltas) {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// expMapping returns mapping with base 2^(2^-scale) used by Prometheus and OpenTelemetry.
+func expMapping(scale int32) LogMapping {
+	return NewLogMappingGamma(math.Exp2(math.Exp2(-float64(scale))), 0)
+}
+
+// expScale checks if m is equivalent to expMapping(scale).
+func expScale(m IndexMapping) (int32, bool) {
+	lm, ok := m.(LogMapping)
+	if !ok || lm.offset != 0 {
+		return 0, false
+	}
+
+	scale := math.Round(math.Log2(lm.multiplier))
+
+	if scale < math.MinInt32 || scale > math.MaxInt32 || expMapping(int32(scale)) != lm {
+		return 0, false
+	}
+
+	return int32(scale), true
+}
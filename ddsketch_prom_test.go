@@ -0,0 +1,112 @@
+package quantile
+
+import (
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestDDPrometheus(tb *testing.T) {
+	s := NewDDLogPrometheus(0, DDDense) // base 2
+
+	for _, v := range []float64{0, 1.5, 1.5, 3, 20, 24, -0.75} {
+		s.Insert(v)
+	}
+
+	var h PromHistogram
+
+	err := s.ToPrometheus(&h)
+	if err != nil {
+		tb.Fatalf("to prometheus: %v", err)
+	}
+
+	exp := PromHistogram{
+		Schema:        0,
+		ZeroThreshold: s.minPossible,
+		ZeroCount:     1,
+		Count:         7,
+
+		PositiveSpans:  []PromSpan{{Offset: 1, Length: 2}, {Offset: 2, Length: 1}}, // (1, 2], (2, 4], (16, 32]
+		PositiveDeltas: []int64{2, -1, 1},
+		NegativeSpans:  []PromSpan{{Offset: 0, Length: 1}}, // (0.5, 1]
+		NegativeDeltas: []int64{1},
+	}
+
+	if !reflect.DeepEqual(h, exp) {
+		tb.Errorf("histogram\n got  %+v\n want %+v", h, exp)
+	}
+
+	d, err := NewDDLogFromPrometheus(&h, DDSparse)
+	if err != nil {
+		tb.Fatalf("from prometheus: %v", err)
+	}
+
+	assertDDEqual(tb, d, s)
+
+	err = NewDDLog(0.01).ToPrometheus(&h)
+	if err != ErrSchemaMismatch {
+		tb.Errorf("expected schema mismatch, got %v", err)
+	}
+}
+
+func TestDDPrometheusRoundTrip(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	var h PromHistogram
+
+	for schema := int32(PromSchemaMin); schema <= PromSchemaMax; schema++ {
+		s := NewDDLogPrometheus(schema, DDDense)
+
+		for range 1000 {
+			s.Insert(r.NormFloat64() * 100)
+		}
+
+		err := s.ToPrometheus(&h)
+		if err != nil {
+			tb.Fatalf("to prometheus: %v", err)
+		}
+
+		if h.Count != 1000 || h.Schema != schema {
+			tb.Errorf("schema %d: count %d  schema %d", schema, h.Count, h.Schema)
+		}
+
+		d, err := NewDDLogFromPrometheus(&h, DDDense)
+		if err != nil {
+			tb.Fatalf("from prometheus: %v", err)
+		}
+
+		assertDDEqual(tb, d, s)
+	}
+
+	h.PositiveDeltas = h.PositiveDeltas[:len(h.PositiveDeltas)-1]
+
+	_, err := NewDDLogFromPrometheus(&h, DDDense)
+	if err != ErrMalformed {
+		tb.Errorf("expected malformed, got %v", err)
+	}
+}
+
+func TestPrometheusHostileSpans(tb *testing.T) {
+	for _, spans := range [][]PromSpan{
+		{{Offset: math.MinInt32 + 10, Length: 1}, {Offset: math.MaxInt32, Length: 1}},
+		{{Offset: math.MaxInt32, Length: 1}},
+		{{Offset: -300000, Length: 1}},
+	} {
+		h := PromHistogram{
+			Schema:         8,
+			PositiveSpans:  spans,
+			PositiveDeltas: make([]int64, len(spans)),
+		}
+
+		h.PositiveDeltas[0] = 1
+
+		for _, st := range []DDStore{DDDense, DDSparse} {
+			_, err := NewDDLogFromPrometheus(&h, st)
+			if err != ErrMalformed {
+				tb.Errorf("spans %v store %v: %v", spans, st, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package quantile
+
+// DDSketch protobuf format compatible with DataDog sketches-go, sketches-py and sketches-java.
+//
+// https://github.com/DataDog/sketches-go/blob/master/ddsketch/pb/ddsketch.proto
+//
+//	message DDSketch {
+//	  IndexMapping mapping = 1;
+//	  Store positiveValues = 2;
+//	  Store negativeValues = 3;
+//	  double zeroCount = 4;
+//	}
+//
+//	message IndexMapping {
+//	  double gamma = 1;
+//	  double indexOffset = 2;
+//	  Interpolation interpolation = 3; // NONE = 0; LINEAR = 1; QUADRATIC = 2; CUBIC = 3;
+//	}
+//
+//	message Store {
+//	  map<sint32, double> binCounts = 1;
+//	  repeated double contiguousBinCounts = 2 [packed = true];
+//	  sint32 contiguousBinIndexOffset = 3;
+//	}
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+type (
+	protoReader struct {
+		b []byte
+		i int
+	}
+)
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoLen     = 2
+	protoFixed32 = 5
+)
+
+// DDSketch IndexMapping interpolation.
+const (
+	ddInterpolationNone = iota
+	ddInterpolationLinear
+	ddInterpolationQuadratic
+	ddInterpolationCubic
+)
+
+var (
+	ErrUnsupportedMapping = errors.New("unsupported index mapping")
+	ErrMalformed          = errors.New("malformed data")
+)
+
+// MarshalProto encodes s into DDSketch protobuf message.
+func (s *DDLog) MarshalProto() ([]byte, error) {
+	return s.AppendProto(nil)
+}
+
+// AppendProto appends DDSketch protobuf message to b.
+func (s *DDLog) AppendProto(b []byte) (_ []byte, err error) {
+	gamma, offset, interp, err := ddMappingParams(s.m)
+	if err != nil {
+		return b, err
+	}
+
+	b = protoAppendMessage(b, 1, func(b []byte) []byte {
+		b = protoAppendDouble(b, 1, gamma)
+		b = protoAppendDouble(b, 2, offset)
+		b = protoAppendVarint(b, 3, uint64(interp))
+
+		return b
+	})
+
+	b = protoAppendMessage(b, 2, func(b []byte) []byte { return protoAppendStore(b, s.pos) })
+	b = protoAppendMessage(b, 3, func(b []byte) []byte { return protoAppendStore(b, s.neg) })
+
+	b = protoAppendDouble(b, 4, s.zeros)
+
+	return b, nil
+}
+
+// UnmarshalProto decodes DDSketch protobuf message into s.
+// Current s data and index mapping are replaced,
+// bins storage kind and other settings are preserved.
+// s is not changed if the message is malformed.
+// The message has no Min, Max and Sum, they are estimated from the bins.
+// Bins are collapsed to fit MaxBins if it's set.
+func (s *DDLog) UnmarshalProto(p []byte) (err error) {
+	var gamma, offset, zeros float64
+	var interp uint64
+	var pos, neg []byte
+
+	err = protoEach(p, func(r *protoReader, field, typ int) (err error) {
+		switch {
+		case field == 1 && typ == protoLen:
+			var m []byte
+
+			m, err = r.bytes()
+			if err != nil {
+				return err
+			}
+
+			return protoEach(m, func(r *protoReader, field, typ int) (err error) {
+				switch {
+				case field == 1 && typ == protoFixed64:
+					gamma, err = r.double()
+				case field == 2 && typ == protoFixed64:
+					offset, err = r.double()
+				case field == 3 && typ == protoVarint:
+					interp, err = r.varint()
+				default:
+					err = r.skip(typ)
+				}
+
+				return err
+			})
+		case field == 2 && typ == protoLen:
+			pos, err = r.bytes()
+		case field == 3 && typ == protoLen:
+			neg, err = r.bytes()
+		case field == 4 && typ == protoFixed64:
+			zeros, err = r.double()
+		default:
+			err = r.skip(typ)
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m, err := ddMapping(gamma, offset, interp)
+	if err != nil {
+		return err
+	}
+
+	if !binIsCount(zeros) {
+		return ErrMalformed
+	}
+
+	x := *s
+	x.reset(m)
+	x.zeros = zeros
+
+	err = protoDecodeStore(x.pos, pos)
+	if err != nil {
+		return fmt.Errorf("positive store: %w", err)
+	}
+
+	err = protoDecodeStore(x.neg, neg)
+	if err != nil {
+		return fmt.Errorf("negative store: %w", err)
+	}
+
+	x.estimateStats()
+
+	if x.MaxBins > 0 {
+		x.fitDecoded(x.pos)
+		x.fitDecoded(x.neg)
+	}
+
+	*s = x
+
+	return nil
+}
+
+// fitDecoded collapses b to MaxBins, which the proto format doesn't carry.
+func (s *DDLog) fitDecoded(b ddstore) {
+	lo, hi, ok := b.bounds()
+	if !ok {
+		return
+	}
+
+	if _, _, collapsed := ddfit(b, lo, hi, s.MaxBins, s.Collapse); collapsed {
+		s.Collapses++
+	}
+}
+
+// reset clears s and sets new mapping keeping the settings.
+func (s *DDLog) reset(m IndexMapping) {
+	st := DDDense
+
+	if s.pos != nil {
+		st = s.pos.kind()
+	}
+
+	*s = DDLog{
+		pos: newDDStore(st),
+		neg: newDDStore(st),
+
+		m:           m,
+		minPossible: m.MinIndexable(),
+		maxPossible: m.MaxIndexable(),
+
+		integer: st&ddCountsMask == DDUint64,
+
+		min: math.Inf(1),
+		max: math.Inf(-1),
+
+		MaxBins:     s.MaxBins,
+		Collapse:    s.Collapse,
+		ShrinkBins:  s.ShrinkBins,
+		Interpolate: s.Interpolate,
+	}
+}
+
+func ddMappingParams(m IndexMapping) (gamma, offset float64, interp int, err error) {
+	switch m := m.(type) {
+	case LogMapping:
+		return m.gamma, m.offset, ddInterpolationNone, nil
+	case LinearMapping:
+		return m.gamma, m.offset, ddInterpolationLinear, nil
+	case CubicMapping:
+		return m.gamma, m.offset, ddInterpolationCubic, nil
+	default:
+		return 0, 0, 0, ErrUnsupportedMapping
+	}
+}
+
+func ddMapping(gamma, offset float64, interp uint64) (IndexMapping, error) {
+	if !(gamma > 1) || math.IsInf(gamma, 0) || math.IsNaN(offset) || math.IsInf(offset, 0) {
+		return nil, ErrMalformed
+	}
+
+	switch interp {
+	case ddInterpolationNone:
+		return NewLogMappingGamma(gamma, offset), nil
+	case ddInterpolationLinear:
+		return NewLinearMappingGamma(gamma, offset), nil
+	case ddInterpolationCubic:
+		return NewCubicMappingGamma(gamma, offset), nil
+	default:
+		return nil, ErrUnsupportedMapping
+	}
+}
+
+// protoAppendStore encodes dense stores as contiguousBinCounts
+// and sparse stores as binCounts map.
+func protoAppendStore(b []byte, st ddstore) []byte {
+	lo, hi, ok := st.bounds()
+	if !ok {
+		return b
+	}
+
+	if st.kind()&ddKindMask == DDSparse {
+		st.each(func(key int, w float64) {
+			b = protoAppendMessage(b, 1, func(b []byte) []byte {
+				// map entries are always written in full
+				b = protoAppendTag(b, 1, protoVarint)
+				b = binary.AppendUvarint(b, protoZigzag(key))
+
+				b = protoAppendTag(b, 2, protoFixed64)
+				b = binary.LittleEndian.AppendUint64(b, math.Float64bits(w))
+
+				return b
+			})
+		})
+
+		return b
+	}
+
+	n := hi - lo + 1
+
+	b = protoAppendTag(b, 2, protoLen)
+	b = binary.AppendUvarint(b, uint64(8*n))
+
+	st0 := len(b)
+	b = append(b, make([]byte, 8*n)...)
+
+	st.each(func(key int, w float64) {
+		binary.LittleEndian.PutUint64(b[st0+8*(key-lo):], math.Float64bits(w))
+	})
+
+	b = protoAppendVarint(b, 3, protoZigzag(lo))
+
+	return b
+}
+
+func protoDecodeStore(st ddstore, p []byte) error {
+	var cont []byte
+	var off uint64
+	var keys []int
+	var ws []float64
+
+	err := protoEach(p, func(r *protoReader, field, typ int) (err error) {
+		switch {
+		case field == 1 && typ == protoLen:
+			var m []byte
+			var key uint64
+			var w float64
+
+			m, err = r.bytes()
+			if err != nil {
+				return err
+			}
+
+			err = protoEach(m, func(r *protoReader, field, typ int) (err error) {
+				switch {
+				case field == 1 && typ == protoVarint:
+					key, err = r.varint()
+				case field == 2 && typ == protoFixed64:
+					w, err = r.double()
+				default:
+					err = r.skip(typ)
+				}
+
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, protoUnzigzag(key))
+			ws = append(ws, w)
+		case field == 2 && typ == protoLen: // packed
+			var m []byte
+
+			m, err = r.bytes()
+			if err != nil {
+				return err
+			}
+			if len(m)%8 != 0 {
+				return ErrMalformed
+			}
+
+			cont = append(cont, m...)
+		case field == 2 && typ == protoFixed64: // not packed
+			if r.i+8 > len(r.b) {
+				return ErrMalformed
+			}
+
+			cont = append(cont, r.b[r.i:r.i+8]...)
+			r.i += 8
+		case field == 3 && typ == protoVarint:
+			off, err = r.varint()
+		default:
+			err = r.skip(typ)
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	first := protoUnzigzag(off)
+
+	for i := 0; i < len(cont); i += 8 {
+		keys = append(keys, first+i/8)
+		ws = append(ws, math.Float64frombits(binary.LittleEndian.Uint64(cont[i:])))
+	}
+
+	// check everything first, so bad data can't make the store allocate a lot.
+
+	lo, hi := math.MaxInt, math.MinInt
+
+	for i, key := range keys {
+		if !binIsCount(ws[i]) || key > math.MaxInt32 {
+			return ErrMalformed
+		}
+
+		if ws[i] != 0 {
+			lo, hi = min(lo, key), max(hi, key)
+		}
+	}
+
+	if lo > hi {
+		return nil
+	}
+
+	if st.kind()&ddKindMask == DDDense {
+		if hi-lo >= binMaxAlloc {
+			return ErrMalformed
+		}
+
+		st.reserve(lo, hi, 0)
+	}
+
+	for i, key := range keys {
+		if ws[i] != 0 {
+			st.add(key, ws[i], 0)
+		}
+	}
+
+	return nil
+}
+
+func protoAppendMessage(b []byte, field int, f func(b []byte) []byte) []byte {
+	b = protoAppendTag(b, field, protoLen)
+
+	st := len(b)
+	b = f(b)
+	n := len(b) - st
+
+	var lb [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(lb[:], uint64(n))
+
+	b = append(b, lb[:l]...)
+	copy(b[st+l:], b[st:st+n])
+	copy(b[st:], lb[:l])
+
+	return b
+}
+
+// protoAppendDouble appends non-zero double field.
+func protoAppendDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protoAppendTag(b, field, protoFixed64)
+
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// protoAppendVarint appends non-zero varint field.
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protoAppendTag(b, field, protoVarint)
+
+	return binary.AppendUvarint(b, v)
+}
+
+func protoAppendTag(b []byte, field, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(typ))
+}
+
+func protoZigzag(x int) uint64 {
+	return uint64(int32(x)<<1 ^ int32(x)>>31)
+}
+
+func protoUnzigzag(x uint64) int {
+	return int(int32(uint32(x)>>1) ^ -int32(x&1))
+}
+
+// protoEach calls f for each field in p.
+// f must consume the field value.
+func protoEach(p []byte, f func(r *protoReader, field, typ int) error) error {
+	r := protoReader{b: p}
+
+	for r.i < len(r.b) {
+		tag, err := r.varint()
+		if err != nil {
+			return err
+		}
+
+		if tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return ErrMalformed
+		}
+
+		err = f(&r, int(tag>>3), int(tag&7))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	x, n := binary.Uvarint(r.b[r.i:])
+	if n <= 0 {
+		return 0, ErrMalformed
+	}
+
+	r.i += n
+
+	return x, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	if r.i+8 > len(r.b) {
+		return 0, ErrMalformed
+	}
+
+	x := binary.LittleEndian.Uint64(r.b[r.i:])
+	r.i += 8
+
+	return math.Float64frombits(x), nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	l, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if l > uint64(len(r.b)-r.i) {
+		return nil, ErrMalformed
+	}
+
+	p := r.b[r.i : r.i+int(l)]
+	r.i += int(l)
+
+	return p, nil
+}
+
+func (r *protoReader) skip(typ int) (err error) {
+	switch typ {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.double()
+	case protoLen:
+		_, err = r.bytes()
+	case protoFixed32:
+		if r.i+4 > len(r.b) {
+			return ErrMalformed
+		}
+
+		r.i += 4
+	default:
+		return ErrMalformed
+	}
+
+	return err
+}
@@ -0,0 +1,304 @@
+package quantile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// Golden payloads encoded the same way as DataDog sketches-go does
+// for NewDefaultDDSketch(0.01) with 1, 1, 1.03, -3 and 0 inserted.
+const (
+	ddProtoDense  = "0a0909fd4a815abf52f03f121212100000000000000040000000000000f03f1a0c1208000000000000f03f186c21000000000000f03f"
+	ddProtoSparse = "0a0909fd4a815abf52f03f121a0a0b08001100000000000000400a0b080211000000000000f03f1a0d0a0b086c11000000000000f03f21000000000000f03f"
+
+	// Linearly interpolated mapping with relative accuracy 0.02 and Java compatible index offset,
+	// positive bins both in the map and not packed contiguous counts and an unknown field.
+	ddProtoForeign = "0a14099f3b5f782b73f03f1142edfa8525ff3840180112250a0b08501100000000000008400a0b08091100000000000000401100000000000010401814380521000000000000e03f"
+)
+
+func TestDDProtoGolden(tb *testing.T) {
+	for _, tc := range []struct {
+		st   DDStore
+		gold string
+	}{
+		{DDDense, ddProtoDense},
+		{DDSparse, ddProtoSparse},
+	} {
+		s := NewDDLogStore(0.01, tc.st)
+
+		for _, v := range []float64{1, 1, 1.03, -3, 0} {
+			s.Insert(v)
+		}
+
+		data, err := s.MarshalProto()
+		if err != nil {
+			tb.Fatalf("marshal: %v", err)
+		}
+
+		gold, _ := hex.DecodeString(tc.gold)
+
+		if !bytes.Equal(data, gold) {
+			tb.Errorf("store %v: marshal mismatch\n got  %x\n want %x", tc.st, data, gold)
+		}
+
+		d := NewDDLogStore(0.02, tc.st)
+
+		err = d.UnmarshalProto(gold)
+		if err != nil {
+			tb.Fatalf("unmarshal: %v", err)
+		}
+
+		if d.m != s.m {
+			tb.Errorf("store %v: mapping %+v  wanted %+v", tc.st, d.m, s.m)
+		}
+
+		assertDDEqual(tb, d, s)
+	}
+}
+
+func TestDDProtoForeign(tb *testing.T) {
+	gold, _ := hex.DecodeString(ddProtoForeign)
+
+	var s DDLog
+
+	err := s.UnmarshalProto(gold)
+	if err != nil {
+		tb.Fatalf("unmarshal: %v", err)
+	}
+
+	m, ok := s.m.(LinearMapping)
+	if !ok {
+		tb.Fatalf("mapping %T", s.m)
+	}
+
+	if a := m.RelativeAccuracy(); math.Abs(a-0.02) > 1e-9 {
+		tb.Errorf("relative accuracy %v", a)
+	}
+
+	if n := NewLinearMapping(0.02); math.Abs(n.offset-m.offset) > 1e-9 || math.Abs(n.norm-m.norm) > 1e-9 {
+		tb.Errorf("mapping %+v  wanted %+v", m, n)
+	}
+
+	var bins []float64
+
+	s.pos.each(func(key int, w float64) {
+		bins = append(bins, float64(key), w)
+	})
+
+	if exp := []float64{-5, 2, 10, 4, 40, 3}; !slices.Equal(bins, exp) {
+		tb.Errorf("positive bins %v  wanted %v", bins, exp)
+	}
+
+	if s.zeros != 0.5 || s.neg.sum() != 0 {
+		tb.Errorf("zeros %v  negative %v", s.zeros, s.neg.sum())
+	}
+
+	for i := range gold {
+		_ = s.UnmarshalProto(gold[:i]) // must not panic
+	}
+}
+
+func TestDDProtoRoundTrip(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, m := range []IndexMapping{NewLogMapping(0.01), NewLinearMapping(0.01), NewCubicMapping(0.01)} {
+		for _, st := range []DDStore{DDDense, DDSparse} {
+			s := NewDDLogMapping(m, st)
+
+			for range 1000 {
+				s.Insert(r.NormFloat64() * 100)
+			}
+
+			data, err := s.MarshalProto()
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			d := NewDDLogStore(0.1, DDSparse-st)
+
+			err = d.UnmarshalProto(data)
+			if err != nil {
+				tb.Fatalf("unmarshal: %v", err)
+			}
+
+			if d.m != s.m {
+				tb.Errorf("mapping %+v  wanted %+v", d.m, s.m)
+			}
+
+			assertDDEqual(tb, d, s)
+		}
+	}
+}
+
+func assertDDEqual(tb testing.TB, d, s *DDLog) {
+	tb.Helper()
+
+	for _, q := range []float64{0, 0.01, 0.1, 0.3, 0.5, 0.7, 0.9, 0.99, 1} {
+		// bins are compared as Query is clamped by Min and Max which formats may not keep
+		xl, xh := d.QueryBounds(q)
+		yl, yh := s.QueryBounds(q)
+
+		if xl != yl || xh != yh {
+			tb.Errorf("q %.2f => [%v, %v]  wanted [%v, %v]", q, xl, xh, yl, yh)
+		}
+	}
+
+	if d.zeros != s.zeros || d.pos.sum() != s.pos.sum() || d.neg.sum() != s.neg.sum() {
+		tb.Errorf("totals %v %v %v  wanted %v %v %v", d.neg.sum(), d.zeros, d.pos.sum(), s.neg.sum(), s.zeros, s.pos.sum())
+	}
+}
+
+func TestDDProtoMalformed(tb *testing.T) {
+	bin := func(key int, w float64) func(b []byte) []byte {
+		return func(b []byte) []byte {
+			return protoAppendMessage(b, 1, func(b []byte) []byte {
+				b = protoAppendVarint(b, 1, protoZigzag(key))
+				b = protoAppendDouble(b, 2, w)
+
+				return b
+			})
+		}
+	}
+
+	cont := func(off int, ws ...float64) func(b []byte) []byte {
+		return func(b []byte) []byte {
+			for _, w := range ws {
+				b = protoAppendTag(b, 2, protoFixed64)
+				b = binary.LittleEndian.AppendUint64(b, math.Float64bits(w))
+			}
+
+			return protoAppendVarint(b, 3, protoZigzag(off))
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		store []func(b []byte) []byte
+	}{
+		{"negative", []func(b []byte) []byte{bin(1, -5)}},
+		{"nan", []func(b []byte) []byte{bin(1, math.NaN())}},
+		{"inf", []func(b []byte) []byte{bin(1, math.Inf(1))}},
+		{"negative_contiguous", []func(b []byte) []byte{cont(3, 1, -1)}},
+		{"inf_contiguous", []func(b []byte) []byte{cont(3, math.Inf(1))}},
+		{"span", []func(b []byte) []byte{bin(math.MinInt32, 1), cont(math.MaxInt32-1, 1)}},
+		{"span_map", []func(b []byte) []byte{bin(math.MinInt32, 1), bin(math.MaxInt32, 1)}},
+	} {
+		b := protoAppendMessage(nil, 1, func(b []byte) []byte {
+			return protoAppendDouble(b, 1, 1.02)
+		})
+
+		b = protoAppendMessage(b, 2, func(b []byte) []byte {
+			for _, f := range tc.store {
+				b = f(b)
+			}
+
+			return b
+		})
+
+		s := NewDDLogStore(0.01, DDDense|DDUint64)
+		s.Insert(1)
+
+		err := s.UnmarshalProto(b)
+		if !errors.Is(err, ErrMalformed) {
+			tb.Errorf("%v: %v", tc.name, err)
+		}
+
+		if s.Count() != 1 {
+			tb.Errorf("%v: sketch is changed by failed unmarshal", tc.name)
+		}
+	}
+}
+
+func TestDDProtoSettings(tb *testing.T) {
+	s := NewDDLog(0.01)
+	s.Insert(1)
+
+	data, err := s.MarshalProto()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	d := NewDDLog(0.02)
+	d.MaxBins = 10
+	d.Collapse = CollapseHighest
+	d.ShrinkBins = 100
+	d.Interpolate = true
+
+	err = d.UnmarshalProto(data)
+	if err != nil {
+		tb.Fatalf("unmarshal: %v", err)
+	}
+
+	if d.MaxBins != 10 || d.Collapse != CollapseHighest || d.ShrinkBins != 100 || !d.Interpolate {
+		tb.Errorf("settings are not preserved: %+v", d)
+	}
+}
+
+func FuzzDDProto(f *testing.F) {
+	for _, gold := range []string{ddProtoDense, ddProtoSparse, ddProtoForeign} {
+		p, _ := hex.DecodeString(gold)
+		f.Add(p)
+	}
+
+	f.Fuzz(func(tb *testing.T, p []byte) {
+		for _, st := range []DDStore{DDDense, DDSparse | DDUint64} {
+			s := NewDDLogStore(0.01, st)
+
+			err := s.UnmarshalProto(p)
+			if err != nil {
+				continue
+			}
+
+			if c := s.Count(); !(c >= 0) {
+				tb.Errorf("store %v: count %v", st, c)
+			}
+
+			_ = s.Query(0.5)
+		}
+	})
+}
+
+func TestDDProtoMaxBins(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+
+		for i := 1; i <= 1000; i++ {
+			s.Insert(float64(i))
+			s.Insert(-float64(i))
+		}
+
+		data, err := s.MarshalProto()
+		if err != nil {
+			tb.Fatalf("marshal: %v", err)
+		}
+
+		d := NewDDLogStore(0.01, st)
+		d.MaxBins = 10
+
+		err = d.UnmarshalProto(data)
+		if err != nil {
+			tb.Fatalf("unmarshal: %v", err)
+		}
+
+		for _, b := range []ddstore{d.pos, d.neg} {
+			var bins int
+
+			b.each(func(key int, w float64) { bins++ })
+
+			if bins > d.MaxBins {
+				tb.Errorf("store %v: %d bins  limit %d", st, bins, d.MaxBins)
+			}
+		}
+
+		if d.Count() != s.Count() || d.Collapses != 2 {
+			tb.Errorf("store %v: count %v  wanted %v  collapses %d", st, d.Count(), s.Count(), d.Collapses)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package quantile
+
+import (
+	"sort"
+	"unsafe"
+)
+
+type (
+	// ddsparse keeps only non-empty bins as key/weight pairs sorted by key.
+	ddsparse[T ddcount] struct {
+		ddbase[T]
+
+		keys []int
+		bins []T
+	}
+)
+
+func (b *ddsparse[T]) add(key int, w float64, limit int) {
+	x := ddround[T](w)
+	if x == 0 {
+		return
+	}
+
+	i := b.search(key)
+
+	if i == len(b.keys) || b.keys[i] != key {
+		b.keys = append(b.keys, 0)
+		b.bins = append(b.bins, 0)
+
+		copy(b.keys[i+1:], b.keys[i:])
+		copy(b.bins[i+1:], b.bins[i:])
+
+		b.keys[i] = key
+		b.bins[i] = 0
+	}
+
+	b.bins[i] += x
+	b.total += x
+}
+
+func (b *ddsparse[T]) sub(key int, w float64) float64 {
+	i := b.search(key)
+	if i == len(b.keys) || b.keys[i] != key {
+		return 0
+	}
+
+	x := min(ddround[T](w), b.bins[i])
+
+	b.bins[i] -= x
+	b.total -= min(x, b.total)
+
+	if b.bins[i] == 0 {
+		copy(b.keys[i:], b.keys[i+1:])
+		copy(b.bins[i:], b.bins[i+1:])
+
+		b.keys = b.keys[:len(b.keys)-1]
+		b.bins = b.bins[:len(b.bins)-1]
+	}
+
+	return float64(x)
+}
+
+func (b *ddsparse[T]) reserve(lo, hi, limit int) {}
+
+func (b *ddsparse[T]) adjust(multiply float64) {
+	b.total = 0
+	j := 0
+
+	for i, x := range b.bins {
+		x = ddround[T](float64(x) * multiply)
+		if x == 0 {
+			continue
+		}
+
+		b.keys[j], b.bins[j] = b.keys[i], x
+		b.total += x
+		j++
+	}
+
+	b.keys = b.keys[:j]
+	b.bins = b.bins[:j]
+}
+
+func (b *ddsparse[T]) bounds() (lo, hi int, ok bool) {
+	if len(b.keys) == 0 {
+		return 0, 0, false
+	}
+
+	return b.keys[0], b.keys[len(b.keys)-1], true
+}
+
+func (b *ddsparse[T]) find(limit float64, eq bool) int {
+	var cum float64
+
+	for i, w := range b.bins {
+		cum += float64(w)
+		if cum > limit || eq && cum == limit {
+			return b.keys[i]
+		}
+	}
+
+	if len(b.keys) == 0 {
+		return 0
+	}
+
+	return b.keys[len(b.keys)-1]
+}
+
+func (b *ddsparse[T]) rank(key int) (below, w float64) {
+	i := b.search(key)
+
+	for _, x := range b.bins[:i] {
+		below += float64(x)
+	}
+
+	if i < len(b.keys) && b.keys[i] == key {
+		w = float64(b.bins[i])
+	}
+
+	return below, w
+}
+
+func (b *ddsparse[T]) nextBin(i int) (key int, w float64, next int, ok bool) {
+	for ; i < len(b.bins); i++ {
+		if b.bins[i] != 0 {
+			return b.keys[i], float64(b.bins[i]), i + 1, true
+		}
+	}
+
+	return 0, 0, i, false
+}
+
+func (b *ddsparse[T]) each(f func(key int, w float64)) {
+	for i, w := range b.bins {
+		if w == 0 {
+			continue
+		}
+
+		f(b.keys[i], float64(w))
+	}
+}
+
+func (b *ddsparse[T]) foldBelow(l int) bool {
+	d := b.search(l)
+	if d == 0 {
+		return false
+	}
+
+	var sum T
+
+	for _, x := range b.bins[:d] {
+		sum += x
+	}
+
+	st := d - 1 // folded bin position
+
+	if d < len(b.keys) && b.keys[d] == l {
+		st = d
+		b.bins[st] += sum
+	} else {
+		b.keys[st] = l
+		b.bins[st] = sum
+	}
+
+	n := copy(b.keys, b.keys[st:])
+	copy(b.bins, b.bins[st:])
+
+	b.keys = b.keys[:n]
+	b.bins = b.bins[:n]
+
+	return sum != 0
+}
+
+func (b *ddsparse[T]) foldAbove(h int) bool {
+	d := b.search(h + 1)
+	if d == len(b.keys) {
+		return false
+	}
+
+	var sum T
+
+	for _, x := range b.bins[d:] {
+		sum += x
+	}
+
+	if d > 0 && b.keys[d-1] == h {
+		b.bins[d-1] += sum
+	} else {
+		b.keys[d] = h
+		b.bins[d] = sum
+		d++
+	}
+
+	b.keys = b.keys[:d]
+	b.bins = b.bins[:d]
+
+	return sum != 0
+}
+
+func (b *ddsparse[T]) search(key int) int {
+	return sort.SearchInts(b.keys, key)
+}
+
+func (b *ddsparse[T]) reset(shrink int) {
+	if shrink > 0 && cap(b.keys) > shrink {
+		b.keys, b.bins = nil, nil
+	}
+
+	b.keys = b.keys[:0]
+	b.bins = b.bins[:0]
+	b.ddbase = ddbase[T]{}
+}
+
+func (b *ddsparse[T]) kind() DDStore { return ddkind[T](DDSparse) }
+
+func (b *ddsparse[T]) size() int {
+	return cap(b.keys)*int(unsafe.Sizeof(0)) + cap(b.bins)*int(unsafe.Sizeof(T(0)))
+}
@@ -1,14 +1,18 @@
 package quantile
 
 import (
+	"fmt"
+	"math"
 	"math/rand/v2"
+	"slices"
+	"sort"
 	"testing"
 )
 
 func TestDDKeys(tb *testing.T) {
 	s := NewDDLog(0.01)
 
-	tb.Logf("min %g  max %g  gamma %g", s.minPossible, s.maxPossible, s.gamma)
+	tb.Logf("min %g  max %g  mapping %+v", s.minPossible, s.maxPossible, s.m)
 
 	tb.Logf("%9.4v -> key %3d", 0.5, s.key(0.5))
 
@@ -88,3 +92,874 @@ func TestCompareNormalDD(tb *testing.T) {
 
 	testCompare(tb, r.NormFloat64, s)
 }
+
+func TestDDMerge(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	a := NewDDLog(0.01)
+	b := NewDDLog(0.01)
+	all := NewDDLog(0.01)
+
+	for i := range 1000 {
+		v := r.NormFloat64() * 100
+
+		if i%3 == 0 {
+			v = 0
+		}
+
+		all.Insert(v)
+
+		if i < 300 {
+			a.Insert(v)
+		} else {
+			b.Insert(v)
+		}
+	}
+
+	err := a.Merge(b)
+	if err != nil {
+		tb.Fatalf("merge: %v", err)
+	}
+
+	for _, q := range []float64{0, 0.01, 0.1, 0.3, 0.5, 0.7, 0.9, 0.99, 1} {
+		if x, y := a.Query(q), all.Query(q); x != y {
+			tb.Errorf("q %.2f => %v  wanted %v", q, x, y)
+		}
+	}
+
+	if tb.Failed() {
+		tb.Logf("merged\n%v", a.dump())
+		tb.Logf("all\n%v", all.dump())
+	}
+
+	err = a.Merge(NewDDLog(0.02))
+	if err != ErrMappingMismatch {
+		tb.Errorf("expected mapping mismatch, got %v", err)
+	}
+}
+
+func TestDDCollapse(tb *testing.T) {
+	for _, mode := range []DDCollapse{CollapseLowest, CollapseHighest, CollapseLowest + 2, CollapseHighest + 2} {
+		s := NewDDLogStore(0.01, DDStore(mode/2))
+		s.MaxBins = 256
+		mode %= 2
+		s.Collapse = mode
+
+		stray := 1e-300
+		if mode == CollapseHighest {
+			stray = 1e300
+		}
+
+		s.Insert(stray)
+		s.Insert(-stray)
+
+		for v := 1.; v < 10; v += 0.01 {
+			s.Insert(v)
+			s.Insert(-v)
+		}
+
+		if ddspan(s.pos) > s.MaxBins || ddspan(s.neg) > s.MaxBins {
+			tb.Errorf("mode %v: bins %d %d  limit %d", mode, ddspan(s.pos), ddspan(s.neg), s.MaxBins)
+		}
+		if s.Collapses == 0 {
+			tb.Errorf("mode %v: no collapses reported", mode)
+		}
+
+		total := s.neg.sum() + s.zeros + s.pos.sum()
+		if total != 2+2*901 {
+			tb.Errorf("mode %v: total %v", mode, total)
+		}
+
+		switch mode {
+		case CollapseLowest:
+			if !s.Accurate(0.25) || !s.Accurate(0.99) || s.Accurate(0.5+0.5/total) || s.Accurate(0.5-0.5/total) {
+				tb.Errorf("mode %v: accuracy report mismatch", mode)
+			}
+		case CollapseHighest:
+			if !s.Accurate(0.25) || !s.Accurate(0.75) || s.Accurate(1-0.1/total) || s.Accurate(0.1/total) {
+				tb.Errorf("mode %v: accuracy report mismatch", mode)
+			}
+		}
+
+		if q := s.Query(0.75); math.Abs(q-5.5) > 0.1 {
+			tb.Errorf("mode %v: q 0.75 => %v", mode, q)
+		}
+
+		if tb.Failed() {
+			tb.Logf("dump\n%v", s.dump())
+		}
+	}
+}
+
+func TestDDMergeCollapse(tb *testing.T) {
+	a := NewDDLog(0.01)
+	a.MaxBins = 64
+
+	b := NewDDLog(0.01)
+
+	for v := 1.; v < 1000; v *= 1.01 {
+		a.Insert(v)
+		b.Insert(v * 1000)
+	}
+
+	err := a.Merge(b)
+	if err != nil {
+		tb.Fatalf("merge: %v", err)
+	}
+
+	if ddspan(a.pos) > a.MaxBins {
+		tb.Errorf("bins %d  limit %d", ddspan(a.pos), a.MaxBins)
+	}
+	if a.Collapses == 0 {
+		tb.Errorf("no collapses reported")
+	}
+	if a.pos.sum() != 2*b.pos.sum() {
+		tb.Errorf("total %v  wanted %v", a.pos.sum(), 2*b.pos.sum())
+	}
+}
+
+func TestDDSparse(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	d := NewDDLog(0.01)
+	s := NewDDLogStore(0.01, DDSparse)
+	m := NewDDLogStore(0.01, DDSparse)
+
+	for i := range 10000 {
+		v := multimodal(r)
+
+		d.Insert(v)
+
+		if i%2 == 0 {
+			s.Insert(v)
+		} else {
+			m.Insert(v)
+		}
+	}
+
+	err := s.Merge(m)
+	if err != nil {
+		tb.Fatalf("merge: %v", err)
+	}
+
+	for _, q := range []float64{0, 0.01, 0.1, 0.3, 0.5, 0.7, 0.9, 0.99, 1} {
+		if x, y := s.Query(q), d.Query(q); x != y {
+			tb.Errorf("q %.2f => %v  wanted %v", q, x, y)
+		}
+	}
+
+	if ddsize(s) >= ddsize(d) {
+		tb.Errorf("sparse is not smaller: %d >= %d bytes", ddsize(s), ddsize(d))
+	}
+
+	tb.Logf("size: dense %d  sparse %d", ddsize(d), ddsize(s))
+
+	if tb.Failed() {
+		tb.Logf("dump\n%v", s.dump())
+	}
+}
+
+func BenchmarkInsertDD(tb *testing.B) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		tb.Run(fmt.Sprintf("Store%d", st), func(tb *testing.B) {
+			s := NewDDLogStore(0.01, st)
+
+			benchInsert(tb, s)
+		})
+	}
+
+	// Baseline is the original insert with the fixed log mapping and dense float32 bins,
+	// Store0 is expected to stay close to it.
+	tb.Run("Baseline", func(tb *testing.B) {
+		s := &ddBaseline{multiplier: 1 / math.Log1p(2*0.01/(1-0.01))}
+
+		benchInsert(tb, s)
+	})
+}
+
+type ddBaseline struct {
+	bins       []float32
+	offset     int
+	total      float64
+	multiplier float64
+}
+
+func (s *ddBaseline) Insert(v float64) {
+	if v < 0 {
+		v = -v
+	}
+
+	key := int(math.Log(v) * s.multiplier)
+
+	if len(s.bins) == 0 {
+		s.offset = key
+	}
+	if key < s.offset {
+		low := key &^ 0x7
+
+		s.bins = append(make([]float32, s.offset-low), s.bins...)
+		s.offset = low
+	}
+	if key >= s.offset+len(s.bins) {
+		s.bins = append(s.bins, make([]float32, key-s.offset-len(s.bins)+1)...)
+	}
+
+	s.bins[key-s.offset]++
+	s.total++
+}
+
+func (s *ddBaseline) Query(q float64) float64 { return 0 }
+
+func BenchmarkInsertMultimodalDD(tb *testing.B) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		tb.Run(fmt.Sprintf("Store%d", st), func(tb *testing.B) {
+			tb.ReportAllocs()
+
+			src := rand.NewChaCha8([32]byte{})
+			r := rand.New(src)
+
+			s := NewDDLogStore(0.01, st)
+
+			for i := 0; i < tb.N; i++ {
+				s.Insert(multimodal(r))
+			}
+
+			tb.ReportMetric(float64(ddsize(s)), "bytes")
+		})
+	}
+}
+
+func BenchmarkQueryDD(tb *testing.B) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		tb.Run(fmt.Sprintf("Store%d", st), func(tb *testing.B) {
+			s := NewDDLogStore(0.01, st)
+
+			benchQuery(tb, s)
+		})
+	}
+}
+
+// multimodal imitates cache latencies: hits at microseconds, misses at seconds.
+func multimodal(r *rand.Rand) float64 {
+	if r.IntN(10) == 0 {
+		return 1 + r.ExpFloat64()
+	}
+
+	return 1e-6 * (1 + r.ExpFloat64())
+}
+
+func ddsize(s *DDLog) (size int) {
+	return s.pos.size() + s.neg.size()
+}
+
+func ddspan(b ddstore) int {
+	lo, hi, ok := b.bounds()
+	if !ok {
+		return 0
+	}
+
+	return hi - lo + 1
+}
+
+func TestDDRemove(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+		exp := NewDDLogStore(0.01, st)
+
+		for _, v := range []float64{1, 2, 3, 0, -4, -5} {
+			s.Insert(v)
+		}
+
+		for _, v := range []float64{1, 3, -5} {
+			exp.Insert(v)
+		}
+
+		s.Remove(2)
+		s.Remove(0)
+		s.Remove(-4)
+
+		s.Remove(100)  // never inserted
+		s.Remove(-100) // never inserted
+		s.InsertWeighted(0, -5)
+
+		assertDDEqual(tb, s, exp)
+
+		s.InsertWeighted(1, -10) // more than there is
+
+		if s.pos.sum() != 1 || ddspan(s.pos) != 1 {
+			tb.Errorf("store %v: positive total %v  span %v", st, s.pos.sum(), ddspan(s.pos))
+		}
+
+		s.Remove(3)
+		s.Remove(-5)
+
+		if s.pos.sum() != 0 || s.neg.sum() != 0 || s.zeros != 0 {
+			tb.Errorf("store %v: totals %v %v %v", st, s.neg.sum(), s.zeros, s.pos.sum())
+		}
+		if x := s.Query(0.5); x != 0 {
+			tb.Errorf("store %v: empty query %v", st, x)
+		}
+	}
+}
+
+func TestDDSubtract(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		cum := NewDDLogStore(0.01, st)
+		prev := NewDDLogStore(0.01, st)
+		delta := NewDDLogStore(0.01, st)
+
+		for i := range 3000 {
+			v := r.NormFloat64() * 100
+			if i%10 == 0 {
+				v = 0
+			}
+
+			cum.Insert(v)
+
+			if i < 2000 {
+				prev.Insert(v)
+			} else {
+				delta.Insert(v)
+			}
+		}
+
+		err := cum.Subtract(prev)
+		if err != nil {
+			tb.Fatalf("subtract: %v", err)
+		}
+
+		assertDDEqual(tb, cum, delta)
+
+		err = cum.Subtract(prev)
+		if err != nil {
+			tb.Fatalf("subtract: %v", err)
+		}
+
+		if total := cum.neg.sum() + cum.zeros + cum.pos.sum(); total < 0 || total > 1000 {
+			tb.Errorf("store %v: total after over-subtraction %v", st, total)
+		}
+
+		for _, b := range []ddstore{cum.pos, cum.neg} {
+			var sum float64
+
+			b.each(func(key int, w float64) {
+				sum += w
+			})
+
+			if sum != b.sum() {
+				tb.Errorf("store %v: bins sum %v  total %v", st, sum, b.sum())
+			}
+		}
+	}
+}
+
+func TestDDSubtractLimited(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+		s.MaxBins = 100
+
+		s1 := NewDDLogStore(0.01, st)
+
+		for i := range 50 {
+			s.Insert(10 + float64(i)/5)
+		}
+
+		// s1 range doesn't fit into s limit, but subtraction must not collapse s
+		for _, v := range []float64{1e-6, 10, 1e6} {
+			s1.Insert(v)
+		}
+
+		err := s.Subtract(s1)
+		if err != nil {
+			tb.Fatalf("subtract: %v", err)
+		}
+
+		if _, ok := s.pos.collapsedKey(); ok || s.Collapses != 0 {
+			tb.Errorf("store %v: collapsed on subtract: %v", st, s.Collapses)
+		}
+
+		if total := s.Count(); total != 49 {
+			tb.Errorf("store %v: total %v  wanted 49", st, total)
+		}
+
+		if q := s.Query(0); q < 10.1 || q > 10.3 {
+			tb.Errorf("store %v: min %v", st, q)
+		}
+	}
+}
+
+func TestDDSubtractSelf(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+
+		for i := range 100 {
+			s.Insert(float64(i - 20))
+		}
+
+		err := s.MergeWeighted(s, 2, 1)
+		if err != nil {
+			tb.Fatalf("merge: %v", err)
+		}
+
+		if c := s.Count(); c != 300 {
+			tb.Errorf("store %v: self merge count %v  wanted 300", st, c)
+		}
+
+		err = s.Subtract(s)
+		if err != nil {
+			tb.Fatalf("subtract: %v", err)
+		}
+
+		if c := s.Count(); c != 0 {
+			tb.Errorf("store %v: self subtract count %v", st, c)
+		}
+	}
+}
+
+func TestDDRelativeAccuracy(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	dists := map[string]func() float64{
+		"uniform":   r.Float64,
+		"normal":    r.NormFloat64,
+		"lognormal": func() float64 { return math.Exp(r.NormFloat64() * 10) },
+		"integers":  func() float64 { return float64(r.IntN(21) - 10) },
+	}
+
+	for name, dist := range dists {
+		for _, m := range []IndexMapping{NewLogMapping(0.01), NewLinearMapping(0.01), NewCubicMapping(0.02)} {
+			for _, st := range []DDStore{DDDense, DDSparse} {
+				e := NewExact()
+				s := NewDDLogMapping(m, st)
+				acc := m.RelativeAccuracy() * (1 + 1e-9)
+
+				for range 1000 + r.IntN(1000) {
+					v := dist()
+
+					e.Insert(v)
+					s.Insert(v)
+				}
+
+				for i := 0; i <= 1000; i++ {
+					q := float64(i) / 1000
+
+					x, y := s.Query(q), e.Query(q)
+					lo, hi := s.QueryBounds(q)
+					eps := 1e-12 * math.Abs(y) // approximated mappings round bin bounds
+
+					if math.Abs(x-y) > acc*math.Abs(y) {
+						tb.Errorf("%v %T %v: q %.3f => %v  wanted %v  rel err %.4f", name, m, st, q, x, y, math.Abs(x-y)/math.Abs(y))
+					}
+
+					if y < lo-eps || y > hi+eps {
+						tb.Errorf("%v %T %v: q %.3f => bounds [%v, %v]  wanted %v", name, m, st, q, lo, hi, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDDCounts(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		for _, c := range []DDStore{DDFloat32, DDFloat64, DDUint64} {
+			s := NewDDLogStore(0.01, st|c)
+
+			s.InsertWeighted(1, 1<<24)
+			s.InsertWeighted(0, 1<<24)
+
+			for range 10 {
+				s.Insert(1)
+				s.Insert(0)
+			}
+
+			var bins float64
+
+			s.pos.each(func(key int, w float64) {
+				bins += w
+			})
+
+			lost := c == DDFloat32
+
+			if exp := float64(1<<24 + 10); (bins != exp) != lost || s.zeros != exp {
+				tb.Errorf("store %x: bins %v  zeros %v  wanted %v", st|c, bins, s.zeros, exp)
+			}
+
+			if bins != s.pos.sum() {
+				tb.Errorf("store %x: bins %v  total %v", st|c, bins, s.pos.sum())
+			}
+
+			if q := s.Query(0.75); math.Abs(q-1) > 0.01*(1+1e-9) {
+				tb.Errorf("store %x: q .75 => %v  wanted %v", st|c, q, 1)
+			}
+
+			if c != DDUint64 {
+				continue
+			}
+
+			s.InsertWeighted(2, 0.4)
+			s.InsertWeighted(2, 0.4)
+			s.InsertWeighted(3, 0.6)
+
+			if s.pos.sum() != bins+1 {
+				tb.Errorf("store %x: weights are not rounded: total %v  wanted %v", st|c, s.pos.sum(), bins+1)
+			}
+
+			p, err := s.MarshalProto()
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			d := NewDDLogStore(0.01, st|c)
+
+			err = d.UnmarshalProto(p)
+			if err != nil {
+				tb.Fatalf("unmarshal: %v", err)
+			}
+
+			if d.pos.sum() != s.pos.sum() || d.zeros != s.zeros || d.pos.kind() != st|c {
+				tb.Errorf("store %x: unmarshaled total %v + %v (kind %x)  wanted %v + %v", st|c, d.pos.sum(), d.zeros, d.pos.kind(), s.pos.sum(), s.zeros)
+			}
+		}
+	}
+}
+
+func TestDDStats(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse | DDUint64} {
+		s := NewDDLogStore(0.01, st)
+		e := NewExact()
+
+		if s.Count() != 0 || s.Min() != 0 || s.Max() != 0 || s.Mean() != 0 || s.Query(0.5) != 0 {
+			tb.Errorf("store %x: empty sketch stats: %v %v %v %v", st, s.Count(), s.Min(), s.Max(), s.Mean())
+		}
+
+		var sum float64
+
+		for range 1000 {
+			v := r.NormFloat64() * 100
+
+			s.Insert(v)
+			e.Insert(v)
+			sum += v
+		}
+
+		s.Insert(0)
+		e.Insert(0)
+
+		mn, mx := e.Query(0), e.Query(1)
+
+		if s.Min() != mn || s.Max() != mx || s.Query(0) != mn || s.Query(1) != mx {
+			tb.Errorf("store %x: min %v (q %v)  max %v (q %v)  wanted %v %v", st, s.Min(), s.Query(0), s.Max(), s.Query(1), mn, mx)
+		}
+
+		if s.Count() != 1001 || math.Abs(s.Sum()-sum) > 1e-9 || math.Abs(s.Mean()-sum/1001) > 1e-12 {
+			tb.Errorf("store %x: count %v  sum %v  mean %v  wanted %v %v", st, s.Count(), s.Sum(), s.Mean(), 1001, sum)
+		}
+
+		s1 := NewDDLogStore(0.01, st)
+		s1.Insert(1e6)
+		s1.Insert(1e6 + 1)
+
+		_ = s.Merge(s1)
+
+		if s.Min() != mn || s.Max() != 1e6+1 || s.Query(1) != 1e6+1 || s.Count() != 1003 {
+			tb.Errorf("store %x: merged: min %v  max %v  q1 %v  count %v", st, s.Min(), s.Max(), s.Query(1), s.Count())
+		}
+
+		if q := s.Query(0.9999); q > 1e6+1 {
+			tb.Errorf("store %x: q .9999 => %v is not clamped", st, q)
+		}
+
+		_ = s.Subtract(s1)
+
+		// max is kept as a bound, but the bin it was in is empty
+		if s.Max() != 1e6+1 || math.Abs(s.Query(1)-mx) > 0.01*math.Abs(mx) || math.Abs(s.Sum()-sum) > 1e-6 {
+			tb.Errorf("store %x: subtracted: max %v  q1 %v  sum %v", st, s.Max(), s.Query(1), s.Sum())
+		}
+
+		s.AdjustWeights(0)
+
+		if s.Count() != 0 || s.Sum() != 0 || s.Min() != 0 || s.Max() != 0 {
+			tb.Errorf("store %x: cleared: count %v  sum %v  min %v  max %v", st, s.Count(), s.Sum(), s.Min(), s.Max())
+		}
+	}
+}
+
+func TestDDRank(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		for _, interp := range []bool{false, true} {
+			s := NewDDLogStore(0.01, st)
+			s.Interpolate = interp
+
+			var vals []float64
+
+			for range 2000 {
+				v := r.NormFloat64() * 100
+
+				s.Insert(v)
+				vals = append(vals, v)
+			}
+
+			for range 100 {
+				s.Insert(0)
+				vals = append(vals, 0)
+			}
+
+			slices.Sort(vals)
+
+			n := float64(len(vals))
+
+			for _, v := range []float64{-1000, -200, -50, -1, -1e-300, 0, 1e-300, 1, 10, 100, 250, 1000} {
+				exp := float64(sort.SearchFloat64s(vals, math.Nextafter(v, math.Inf(1))))
+
+				// values within the relative accuracy from v may be counted or not
+				lo := float64(sort.SearchFloat64s(vals, v-0.021*math.Abs(v)))
+				hi := float64(sort.SearchFloat64s(vals, math.Nextafter(v+0.021*math.Abs(v), math.Inf(1))))
+
+				rank := s.Rank(v)
+
+				if rank < lo || rank > hi {
+					tb.Errorf("store %v interp %v: rank(%v) => %v  wanted %v [%v, %v]", st, interp, v, rank, exp, lo, hi)
+				}
+
+				if cdf := s.CDF(v); math.Abs(cdf-rank/n) > 1e-12 {
+					tb.Errorf("store %v interp %v: cdf(%v) => %v  wanted %v", st, interp, v, cdf, rank/n)
+				}
+			}
+
+			for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+				v := s.Query(q)
+
+				if cdf := s.CDF(v); cdf < q && !interp {
+					tb.Errorf("store %v: cdf(query(%v)) => %v", st, q, cdf)
+				}
+			}
+
+			vs := []float64{vals[0] - 1, vals[0], 0, vals[len(vals)-1]}
+			res := make([]float64, len(vs))
+
+			s.CDFMulti(vs, res)
+
+			if exp := []float64{0, s.CDF(vals[0]), s.CDF(0), 1}; !slices.Equal(res, exp) {
+				tb.Errorf("store %v interp %v: cdf multi %v  wanted %v", st, interp, res, exp)
+			}
+		}
+	}
+}
+
+func TestDDQueryMulti(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+
+		qs := []float64{0.5, 0, 1, 0.1, 0.99, 0.5, -1, 2, 0.3, 0.01}
+		res := make([]float64, len(qs))
+
+		s.QueryMulti(qs, res)
+
+		if exp := make([]float64, len(qs)); !slices.Equal(res, exp) {
+			tb.Errorf("store %v: empty: %v", st, res)
+		}
+
+		for range 1000 {
+			s.Insert(r.NormFloat64() * 100)
+		}
+
+		for range 100 {
+			s.Insert(0)
+		}
+
+		for range 100 {
+			qs = append(qs, r.Float64())
+		}
+
+		for i := 0; i <= 100; i++ {
+			qs = append(qs, float64(i)/100)
+		}
+
+		res = make([]float64, len(qs))
+
+		s.QueryMulti(qs, res)
+
+		for i, q := range qs {
+			if exp := s.Query(q); res[i] != exp {
+				tb.Errorf("store %v: q %v => %v  wanted %v", st, q, res[i], exp)
+			}
+		}
+	}
+}
+
+func TestDDQueryMultiAllocs(tb *testing.T) {
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		s := NewDDLogStore(0.01, st)
+
+		for range 1000 {
+			s.Insert(r.NormFloat64() * 100)
+		}
+
+		data, err := s.MarshalBinary()
+		if err != nil {
+			tb.Fatalf("marshal: %v", err)
+		}
+
+		v, err := NewDDLogView(data)
+		if err != nil {
+			tb.Fatalf("view: %v", err)
+		}
+
+		qs := []float64{0.99, 0.5, 0.01, 0.9, 0, 1}
+		res := make([]float64, len(qs))
+
+		allocs := testing.AllocsPerRun(100, func() {
+			s.QueryMulti(qs, res)
+			v.QueryMulti(qs, res)
+		})
+		if allocs != 0 {
+			tb.Errorf("store %v: allocs: %v", st, allocs)
+		}
+	}
+}
+
+func TestDDCDFMulti(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, st := range []DDStore{DDDense, DDSparse} {
+		for _, interp := range []bool{false, true} {
+			s := NewDDLogStore(0.01, st)
+			s.Interpolate = interp
+
+			vs := []float64{0.5, 0, -1, 1e-300, math.NaN(), math.Inf(1), math.Inf(-1)}
+			res := make([]float64, len(vs))
+
+			s.CDFMulti(vs, res)
+
+			if exp := make([]float64, len(vs)); !slices.Equal(res, exp) {
+				tb.Errorf("store %v interp %v: empty: %v", st, interp, res)
+			}
+
+			for range 1000 {
+				s.Insert(r.NormFloat64() * 100)
+			}
+
+			for range 100 {
+				s.Insert(0)
+			}
+
+			for range 1000 {
+				vs = append(vs, r.NormFloat64()*120)
+			}
+
+			for i := -100; i <= 100; i++ {
+				vs = append(vs, float64(i))
+			}
+
+			res = make([]float64, len(vs))
+
+			s.CDFMulti(vs, res)
+
+			for i, v := range vs {
+				if exp := s.CDF(v); res[i] != exp && !(math.IsNaN(res[i]) && math.IsNaN(exp)) {
+					tb.Errorf("store %v interp %v: cdf(%v) => %v  wanted %v", st, interp, v, res[i], exp)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkQueryMultiDD(tb *testing.B) {
+	tb.ReportAllocs()
+
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	s := NewDDLog(0.01)
+
+	for range int(1e5) {
+		s.Insert(multimodal(r))
+	}
+
+	qs := []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999}
+	res := make([]float64, len(qs))
+
+	tb.ResetTimer()
+
+	for i := 0; i < tb.N; i++ {
+		s.QueryMulti(qs, res)
+	}
+}
+
+func TestDDReset(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	vs := make([]float64, 1000)
+
+	for i := range vs {
+		vs[i] = r.NormFloat64() * 100
+	}
+
+	for _, st := range []DDStore{DDDense, DDSparse, DDSparse | DDUint64} {
+		s := NewDDLogStore(0.01, st)
+
+		cycle := func() {
+			for _, v := range vs {
+				s.Insert(v)
+			}
+
+			s.Reset()
+		}
+
+		cycle()
+
+		if allocs := testing.AllocsPerRun(10, cycle); allocs != 0 {
+			tb.Errorf("store %x: %v allocs per cycle", st, allocs)
+		}
+
+		if s.Count() != 0 || s.Query(0.5) != 0 || s.Sum() != 0 {
+			tb.Errorf("store %x: not empty after reset: count %v  sum %v", st, s.Count(), s.Sum())
+		}
+
+		size := ddsize(s)
+
+		if size == 0 {
+			tb.Errorf("store %x: memory is not kept", st)
+		}
+
+		s.ShrinkBins = 10
+
+		cycle()
+
+		if size := ddsize(s); size != 0 {
+			tb.Errorf("store %x: memory is not released: %v bytes", st, size)
+		}
+
+		for _, v := range vs[:5] {
+			s.Insert(v)
+		}
+
+		e := NewDDLogStore(0.01, st)
+
+		for _, v := range vs[:5] {
+			e.Insert(v)
+		}
+
+		assertDDEqual(tb, s, e)
+	}
+}
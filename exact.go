@@ -3,6 +3,8 @@ package quantile
 import (
 	"fmt"
 	"math"
+	"math/bits"
+	"slices"
 	"sort"
 	"strings"
 )
@@ -10,9 +12,44 @@ import (
 type (
 	Exact struct {
 		v []float64
+		w []float32 // nil if all the weights are 1
 
-		sorted bool
+		cum   []float64 // sorted weights prefix sums
+		total float64   // weights sum
+
+		sorted  bool
+		queries int // since the last Insert, to decide whether to sort
+
+		Method ExactMethod
 	}
+
+	exactSorter Exact
+
+	// ExactMethod is a sample quantile definition.
+	// Methods 1 to 9 are Hyndman and Fan types from
+	// "Sample Quantiles in Statistical Packages" (1996),
+	// named as in R, numpy and PostgreSQL.
+	ExactMethod int
+)
+
+const (
+	// ExactIndex is sorted[int(q*n)], the default.
+	ExactIndex ExactMethod = iota
+
+	// Discontinuous methods.
+
+	ExactInvertedCDF         // type 1, nearest rank
+	ExactAveragedInvertedCDF // type 2
+	ExactClosestObservation  // type 3, SAS
+
+	// Piecewise linear methods.
+
+	ExactInterpolatedInvertedCDF // type 4
+	ExactHazen                   // type 5
+	ExactWeibull                 // type 6, Excel PERCENTILE.EXC
+	ExactLinear                  // type 7, R and numpy default, Excel PERCENTILE.INC, PostgreSQL percentile_cont
+	ExactMedianUnbiased          // type 8
+	ExactNormalUnbiased          // type 9
 )
 
 func NewExact() *Exact {
@@ -20,42 +57,363 @@ func NewExact() *Exact {
 }
 
 func (s *Exact) Query(q float64) float64 {
+	var buf [1]float64
+
+	s.QueryMulti([]float64{q}, buf[:])
+
+	return buf[0]
+}
+
+// QueryMulti makes multiple queries at once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+//
+// Values are not sorted for a few queries, only the required order statistics are selected.
+// The full sort is made once the number of queries since the last Insert makes it cheaper.
+// Weighted values are always sorted.
+func (s *Exact) QueryMulti(qs, res []float64) {
 	if len(s.v) == 0 {
-		return 0
+		clear(res[:len(qs)])
+		return
 	}
 
 	if !s.sorted {
-		s.sort()
+		s.queries += len(qs)
+
+		if s.w != nil || s.queries > bits.Len(uint(len(s.v))) {
+			s.sort()
+		} else {
+			s.selectAll(qs)
+		}
+	}
+
+	if s.w != nil {
+		s.prefixSums()
+	}
+
+	for k, q := range qs {
+		i, j, h := s.pos(q)
+
+		switch h {
+		case 0:
+			res[k] = s.v[i]
+		case 1:
+			res[k] = s.v[j]
+		default:
+			res[k] = (1-h)*s.v[i] + h*s.v[j]
+		}
+	}
+}
+
+// pos returns q quantile as sorted values i and j interpolated with h weight.
+// Weighted values are treated as if each one was repeated weight times.
+func (s *Exact) pos(q float64) (i, j int, h float64) {
+	n := len(s.v)
+
+	switch {
+	case q <= 0:
+		return 0, 0, 0
+	case q >= 1:
+		return n - 1, n - 1, 0
+	case s.w != nil && s.Method == ExactIndex:
+		i = sort.Search(n, func(i int) bool { return s.cum[i] > q*s.total })
+
+		return min(i, n-1), min(i, n-1), 0
+	case s.w != nil:
+		p, h := s.Method.hyndmanFan(q, s.total)
+
+		i = sort.SearchFloat64s(s.cum, float64(p))
+		j = sort.SearchFloat64s(s.cum, float64(p+1))
+
+		return min(i, n-1), min(j, n-1), h
 	}
 
-	if q <= 0 {
-		return s.v[0]
+	return s.Method.pos(q, n)
+}
+
+// pos returns q quantile of n sorted values as values i and j interpolated with h weight.
+func (m ExactMethod) pos(q float64, n int) (i, j int, h float64) {
+	switch {
+	case q <= 0:
+		return 0, 0, 0
+	case q >= 1:
+		return n - 1, n - 1, 0
+	case m == ExactIndex:
+		i = min(int(q*float64(n)), n-1)
+
+		return i, i, 0
 	}
-	if q >= 1 {
-		return s.v[len(s.v)-1]
+
+	i, h = m.hyndmanFan(q, float64(n))
+
+	return min(max(i-1, 0), n-1), min(max(i, 0), n-1), h
+}
+
+// hyndmanFan computes q quantile position in n values the same way R quantile does.
+// The result is 1-based index of the lower value and the weight of the upper one.
+func (m ExactMethod) hyndmanFan(q, n float64) (j int, h float64) {
+	const fuzz = 4 * 0x1p-52
+
+	var pos float64
+
+	switch m {
+	case ExactInvertedCDF, ExactAveragedInvertedCDF:
+		pos = n * q
+	case ExactClosestObservation:
+		pos = n*q - 0.5
+	default:
+		a, b := m.params()
+		pos = a + q*(n+1-a-b)
 	}
 
-	i := int(q * float64(len(s.v)))
-	if i == len(s.v) {
-		i--
+	fj := math.Floor(pos + fuzz)
+
+	switch m {
+	case ExactInvertedCDF:
+		h = b2f(pos > fj)
+	case ExactAveragedInvertedCDF:
+		h = (b2f(pos > fj) + 1) / 2
+	case ExactClosestObservation:
+		h = b2f(pos != fj || int(fj)%2 == 1)
+	default:
+		h = pos - fj
+
+		if math.Abs(h) < fuzz {
+			h = 0
+		}
 	}
 
-	return s.v[i]
+	return int(fj), h
+}
+
+// selectAll puts the order statistics required by qs to their sorted positions.
+func (s *Exact) selectAll(qs []float64) {
+	var buf [8]int
+
+	ks := buf[:0]
+
+	for _, q := range qs {
+		i, j, _ := s.pos(q)
+
+		ks = append(ks, i, j)
+	}
+
+	slices.Sort(ks)
+	ks = slices.Compact(ks)
+
+	exactSelect(s.v, 0, ks, 2*bits.Len(uint(len(s.v))))
+}
+
+// exactSelect is a multi-select introselect.
+// It reorders v so that v[k-off] is the value it would be in sorted v for each k in ks.
+// ks must be sorted.
+// depth limits the recursion after which the sort is used.
+func exactSelect(v []float64, off int, ks []int, depth int) {
+	for len(ks) != 0 {
+		if len(v) <= 16 || depth == 0 {
+			slices.Sort(v)
+			return
+		}
+
+		depth--
+
+		lt, gt := exactPartition(v)
+
+		l, _ := slices.BinarySearch(ks, off+lt)
+		r, _ := slices.BinarySearch(ks, off+gt)
+
+		// [lt, gt) values are equal to the pivot and already in place
+
+		if l < len(ks)-r {
+			exactSelect(v[:lt], off, ks[:l], depth)
+
+			v, off, ks = v[gt:], off+gt, ks[r:]
+		} else {
+			exactSelect(v[gt:], off+gt, ks[r:], depth)
+
+			v, ks = v[:lt], ks[:l]
+		}
+	}
+}
+
+// exactPartition partitions v around median of three pivot.
+// Values less than pivot are moved to v[:lt], greater ones to v[gt:].
+func exactPartition(v []float64) (lt, gt int) {
+	m := len(v) / 2
+	a, b, c := v[0], v[m], v[len(v)-1]
+
+	p := max(min(a, b), min(max(a, b), c))
+
+	lt, gt = 0, len(v)
+
+	for i := 0; i < gt; {
+		switch {
+		case v[i] < p:
+			v[i], v[lt] = v[lt], v[i]
+			lt++
+			i++
+		case v[i] > p:
+			gt--
+			v[i], v[gt] = v[gt], v[i]
+		default:
+			i++
+		}
+	}
+
+	return lt, gt
+}
+
+// params returns plotting position parameters a and b for continuous methods.
+func (m ExactMethod) params() (a, b float64) {
+	switch m {
+	case ExactInterpolatedInvertedCDF:
+		return 0, 1
+	case ExactHazen:
+		return 0.5, 0.5
+	case ExactWeibull:
+		return 0, 0
+	case ExactLinear:
+		return 1, 1
+	case ExactMedianUnbiased:
+		return 1.0 / 3, 1.0 / 3
+	case ExactNormalUnbiased:
+		return 3.0 / 8, 3.0 / 8
+	default:
+		panic(m)
+	}
+}
+
+func b2f(x bool) float64 {
+	if x {
+		return 1
+	}
+
+	return 0
 }
 
 func (s *Exact) Insert(v float64) {
-	if math.IsNaN(v) {
+	s.InsertWeighted(v, 1)
+}
+
+// InsertWeighted adds v with weight w.
+// Weights are kept, so weighted quantiles are exact too.
+// Non-positive weights are ignored.
+func (s *Exact) InsertWeighted(v float64, w float32) {
+	if math.IsNaN(v) || !(w > 0) {
 		return
 	}
 
+	if w != 1 && s.w == nil {
+		s.w = make([]float32, len(s.v), cap(s.v))
+
+		for i := range s.w {
+			s.w[i] = 1
+		}
+	}
+
 	s.sorted = len(s.v) == 0 || s.sorted && v > s.v[len(s.v)-1]
+	s.queries = 0
 
 	s.v = append(s.v, v)
+	s.total += float64(w)
+
+	if s.w != nil {
+		s.w = append(s.w, w)
+	}
+}
+
+// Merge adds s1 values to s.
+func (s *Exact) Merge(s1 *Exact) {
+	if len(s1.v) == 0 {
+		return
+	}
+
+	if s1.w == nil {
+		for _, v := range s1.v {
+			s.Insert(v)
+		}
+
+		return
+	}
+
+	for i, v := range s1.v {
+		s.InsertWeighted(v, s1.w[i])
+	}
+}
+
+// Rank returns the total weight of values less than or equal to v.
+func (s *Exact) Rank(v float64) float64 {
+	var rank float64
+
+	for i, x := range s.v {
+		if x > v {
+			continue
+		}
+
+		if s.w == nil {
+			rank++
+		} else {
+			rank += float64(s.w[i])
+		}
+	}
+
+	return rank
+}
+
+// CDF returns the fraction of values less than or equal to v.
+func (s *Exact) CDF(v float64) float64 {
+	if s.total == 0 {
+		return 0
+	}
+
+	return s.Rank(v) / s.total
+}
+
+// Count returns the total weight of inserted values.
+func (s *Exact) Count() float64 {
+	return s.total
+}
+
+// Reset clears s keeping the allocated memory.
+func (s *Exact) Reset() {
+	s.v = s.v[:0]
+	s.w = nil
+	s.cum = s.cum[:0]
+	s.total = 0
+
+	s.sorted = false
+	s.queries = 0
 }
 
 func (s *Exact) sort() {
-	sort.Float64s(s.v)
+	if s.w == nil {
+		slices.Sort(s.v)
+	} else {
+		sort.Sort((*exactSorter)(s))
+	}
+
 	s.sorted = true
+	s.cum = s.cum[:0]
+}
+
+// prefixSums extends cum to cover sorted values.
+func (s *Exact) prefixSums() {
+	var sum float64
+
+	if len(s.cum) != 0 {
+		sum = s.cum[len(s.cum)-1]
+	}
+
+	for _, w := range s.w[len(s.cum):] {
+		sum += float64(w)
+		s.cum = append(s.cum, sum)
+	}
+}
+
+func (s *exactSorter) Len() int           { return len(s.v) }
+func (s *exactSorter) Less(i, j int) bool { return s.v[i] < s.v[j] }
+func (s *exactSorter) Swap(i, j int) {
+	s.v[i], s.v[j] = s.v[j], s.v[i]
+	s.w[i], s.w[j] = s.w[j], s.w[i]
 }
 
 func (s *Exact) dump() string {
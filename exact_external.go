@@ -0,0 +1,444 @@
+package quantile
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+type (
+	// ExternalExact computes exact quantiles over more values than fit in memory.
+	// Values are buffered in memory and spilled to temp files as sorted runs
+	// when the buffer reaches the memory budget.
+	// Queries merge all the runs in one sequential pass.
+	//
+	// Insert can't return an error, so the first I/O error is kept
+	// and reported by Err, queries return NaN after it.
+	// Close must be called to remove temp files.
+	ExternalExact struct {
+		dir    string
+		budget int // values
+
+		buf  []float64
+		runs []exfile
+		n    int
+
+		err error
+
+		Method ExactMethod
+
+		// MaxRuns limits the number of runs merged at once.
+		// When it's reached the smallest half of the runs is merged into one,
+		// so runs sizes grow geometrically and each value is rewritten
+		// a logarithmic number of times.
+		MaxRuns int
+
+		Spills       int
+		Merges       int
+		BytesWritten int64
+		BytesRead    int64
+	}
+
+	exfile struct {
+		*os.File
+		n int // values
+	}
+
+	exrun struct {
+		r *bufio.Reader
+		v float64
+	}
+
+	exheap []exrun
+)
+
+var ErrClosed = errors.New("closed")
+
+// NewExternalExact creates ExternalExact keeping temp files in dir
+// (os.TempDir if empty) and up to budget bytes of values in memory.
+func NewExternalExact(dir string, budget int) *ExternalExact {
+	if budget < 8 {
+		panic(budget)
+	}
+
+	return &ExternalExact{
+		dir:     dir,
+		budget:  budget / 8,
+		MaxRuns: 64,
+	}
+}
+
+func (s *ExternalExact) Insert(v float64) {
+	if math.IsNaN(v) || s.err != nil {
+		return
+	}
+
+	if len(s.buf) == s.budget {
+		s.spill()
+	}
+
+	s.buf = append(s.buf, v)
+	s.n++
+}
+
+// InsertWeighted inserts v w times.
+// w must be a whole number up to MaxRepeats, other weights are ignored.
+func (s *ExternalExact) InsertWeighted(v float64, w float32) {
+	for range repeats(w) {
+		s.Insert(v)
+	}
+}
+
+func (s *ExternalExact) Query(q float64) float64 {
+	var buf [1]float64
+
+	s.QueryMulti([]float64{q}, buf[:])
+
+	return buf[0]
+}
+
+// QueryMulti makes multiple queries at once reading all the runs once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+func (s *ExternalExact) QueryMulti(qs, res []float64) {
+	if s.err != nil {
+		for i := range qs {
+			res[i] = math.NaN()
+		}
+
+		return
+	}
+
+	if s.n == 0 {
+		clear(res[:len(qs)])
+		return
+	}
+
+	ks := make([]int, 0, 2*len(qs))
+
+	for _, q := range qs {
+		i, j, _ := s.Method.pos(q, s.n)
+
+		ks = append(ks, i, j)
+	}
+
+	slices.Sort(ks)
+	ks = slices.Compact(ks)
+
+	vals := make([]float64, len(ks))
+	k := 0
+
+	slices.Sort(s.buf)
+
+	err := s.merge(s.runs, s.buf, func(i int, v float64) bool {
+		for k < len(ks) && ks[k] == i {
+			vals[k] = v
+			k++
+		}
+
+		return k < len(ks)
+	})
+	if err != nil {
+		s.err = err
+
+		for i := range qs {
+			res[i] = math.NaN()
+		}
+
+		return
+	}
+
+	at := func(i int) float64 {
+		k, _ := slices.BinarySearch(ks, i)
+
+		return vals[k]
+	}
+
+	for k, q := range qs {
+		i, j, h := s.Method.pos(q, s.n)
+
+		switch h {
+		case 0:
+			res[k] = at(i)
+		case 1:
+			res[k] = at(j)
+		default:
+			res[k] = (1-h)*at(i) + h*at(j)
+		}
+	}
+}
+
+// Rank returns the number of values less than or equal to v.
+// It reads all the runs up to the first greater value.
+func (s *ExternalExact) Rank(v float64) float64 {
+	if s.err != nil {
+		return math.NaN()
+	}
+
+	if s.n == 0 || math.IsNaN(v) {
+		return 0
+	}
+
+	var rank int
+
+	slices.Sort(s.buf)
+
+	err := s.merge(s.runs, s.buf, func(i int, x float64) bool {
+		if x > v {
+			return false
+		}
+
+		rank = i + 1
+
+		return true
+	})
+	if err != nil {
+		s.err = err
+		return math.NaN()
+	}
+
+	return float64(rank)
+}
+
+func (s *ExternalExact) Count() float64 {
+	return float64(s.n)
+}
+
+// Err returns the first I/O error occurred.
+func (s *ExternalExact) Err() error {
+	return s.err
+}
+
+// Reset removes all the values and temp files.
+func (s *ExternalExact) Reset() {
+	s.err = s.removeRuns()
+
+	s.buf = s.buf[:0]
+	s.n = 0
+}
+
+// Close removes temp files and makes s unusable.
+func (s *ExternalExact) Close() error {
+	err := s.removeRuns()
+
+	s.buf = nil
+	s.n = 0
+	s.err = ErrClosed
+
+	return err
+}
+
+func (s *ExternalExact) removeRuns() error {
+	err := removeFiles(s.runs)
+
+	s.runs = s.runs[:0]
+
+	return err
+}
+
+func removeFiles(files []exfile) (err error) {
+	for _, f := range files {
+		e := f.Close()
+		if err == nil {
+			err = e
+		}
+
+		e = os.Remove(f.Name())
+		if err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// spill writes the buffer as a sorted run.
+func (s *ExternalExact) spill() {
+	if len(s.runs) >= s.MaxRuns && s.MaxRuns > 0 {
+		s.compact()
+	}
+
+	slices.Sort(s.buf)
+
+	s.err = s.writeRun(len(s.buf), func(w *bufio.Writer) error {
+		for _, v := range s.buf {
+			err := s.write(w, v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	s.buf = s.buf[:0]
+	s.Spills++
+}
+
+// compact merges the smallest half of the runs into one.
+func (s *ExternalExact) compact() {
+	if s.err != nil {
+		return
+	}
+
+	slices.SortFunc(s.runs, func(a, b exfile) int { return b.n - a.n })
+
+	keep := len(s.runs) / 2
+	n := 0
+
+	for _, f := range s.runs[keep:] {
+		n += f.n
+	}
+
+	old := slices.Clone(s.runs[keep:])
+	s.runs = s.runs[:keep]
+
+	s.err = s.writeRun(n, func(w *bufio.Writer) error {
+		var werr error
+
+		err := s.merge(old, nil, func(_ int, v float64) bool {
+			werr = s.write(w, v)
+
+			return werr == nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return werr
+	})
+
+	err := removeFiles(old)
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ExternalExact) writeRun(n int, f func(w *bufio.Writer) error) (err error) {
+	if s.err != nil {
+		return s.err
+	}
+
+	file, err := os.CreateTemp(s.dir, "quantile-run-*")
+	if err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, exfile{File: file, n: n})
+
+	w := bufio.NewWriter(file)
+
+	err = f(w)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (s *ExternalExact) write(w *bufio.Writer, v float64) error {
+	var b [8]byte
+
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+
+	_, err := w.Write(b[:])
+
+	s.BytesWritten += 8
+
+	return err
+}
+
+// merge calls f with each value of sorted runs and mem and its index
+// in sorted order until f returns false.
+func (s *ExternalExact) merge(runs []exfile, mem []float64, f func(i int, v float64) bool) error {
+	s.Merges++
+
+	h := make(exheap, 0, len(runs))
+
+	for _, file := range runs {
+		_, err := file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		r := exrun{r: bufio.NewReader(file)}
+
+		ok, err := s.next(&r)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			h = append(h, r)
+		}
+	}
+
+	heap.Init(&h)
+
+	i := 0
+
+	for len(h) != 0 || len(mem) != 0 {
+		var v float64
+
+		if len(h) != 0 && (len(mem) == 0 || h[0].v < mem[0]) {
+			v = h[0].v
+
+			ok, err := s.next(&h[0])
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		} else {
+			v = mem[0]
+			mem = mem[1:]
+		}
+
+		if !f(i, v) {
+			return nil
+		}
+
+		i++
+	}
+
+	return nil
+}
+
+func (s *ExternalExact) next(r *exrun) (bool, error) {
+	var b [8]byte
+
+	_, err := io.ReadFull(r.r, b[:])
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.BytesRead += 8
+	r.v = math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+
+	return true, nil
+}
+
+func (h exheap) Len() int           { return len(h) }
+func (h exheap) Less(i, j int) bool { return h[i].v < h[j].v }
+func (h exheap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *exheap) Push(x any) { *h = append(*h, x.(exrun)) }
+
+func (h *exheap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
@@ -0,0 +1,93 @@
+package quantile
+
+import (
+	"math/rand/v2"
+	"os"
+	"testing"
+)
+
+func TestExternalExact(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	dir := tb.TempDir()
+
+	qs := []float64{0, 0.001, 0.1, 0.25, 0.5, 0.75, 0.9, 0.999, 1}
+
+	for _, m := range []ExactMethod{ExactIndex, ExactLinear, ExactClosestObservation} {
+		e := &Exact{Method: m}
+		s := NewExternalExact(dir, 1024) // 128 values
+		s.Method = m
+		s.MaxRuns = 8
+
+		for range 10000 {
+			v := r.NormFloat64()
+
+			e.Insert(v)
+			s.Insert(v)
+		}
+
+		res := make([]float64, len(qs))
+		exp := make([]float64, len(qs))
+
+		s.QueryMulti(qs, res)
+		e.QueryMulti(qs, exp)
+
+		if err := s.Err(); err != nil {
+			tb.Fatalf("type %d: %v", m, err)
+		}
+
+		for i, q := range qs {
+			if res[i] != exp[i] {
+				tb.Errorf("type %d: q %v => %v  wanted %v", m, q, res[i], exp[i])
+			}
+		}
+
+		if s.Count() != 10000 || s.Spills != 10000/128 || s.Merges == 1 || s.BytesWritten < 8*10000 || s.BytesRead == 0 {
+			tb.Errorf("type %d: count %v  spills %d  merges %d  written %d  read %d", m, s.Count(), s.Spills, s.Merges, s.BytesWritten, s.BytesRead)
+		}
+
+		if len(s.runs) > s.MaxRuns {
+			tb.Errorf("type %d: %d runs", m, len(s.runs))
+		}
+
+		tb.Logf("type %d: spills %d  merges %d  written %d  read %d", m, s.Spills, s.Merges, s.BytesWritten, s.BytesRead)
+
+		s.Reset()
+
+		if x := s.Query(0.5); x != 0 || s.Count() != 0 {
+			tb.Errorf("type %d: after reset: q .5 => %v  count %v", m, x, s.Count())
+		}
+
+		s.Insert(2)
+		s.Insert(1)
+		s.Insert(3)
+
+		if x := s.Query(0.5); x != 2 {
+			tb.Errorf("type %d: q .5 => %v  wanted 2", m, x)
+		}
+
+		err := s.Close()
+		if err != nil {
+			tb.Errorf("close: %v", err)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		tb.Fatalf("read dir: %v", err)
+	}
+
+	if len(files) != 0 {
+		tb.Errorf("temp files left: %v", files)
+	}
+
+	s := NewExternalExact(dir+"/nonexistent", 8)
+
+	s.Insert(1)
+	s.Insert(2)
+
+	if s.Err() == nil || s.Query(0.5) == s.Query(0.5) {
+		tb.Errorf("expected error and NaN result")
+	}
+}
@@ -0,0 +1,286 @@
+package quantile
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestExactMethods(tb *testing.T) {
+	// R: quantile(c(1, 3, 4, 7, 8, 12, 15, 16, 20, 21), c(0, .1, .25, .5, .75, .9, 1), type = t)
+	vals := []float64{21, 1, 12, 3, 16, 4, 20, 7, 15, 8}
+	qs := []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 1}
+
+	exp := map[ExactMethod][]float64{
+		ExactInvertedCDF:             {1, 1, 4, 8, 16, 20, 21},
+		ExactAveragedInvertedCDF:     {1, 2, 4, 10, 16, 20.5, 21},
+		ExactClosestObservation:      {1, 1, 3, 8, 16, 20, 21},
+		ExactInterpolatedInvertedCDF: {1, 1, 3.5, 8, 15.5, 20, 21},
+		ExactHazen:                   {1, 2, 4, 10, 16, 20.5, 21},
+		ExactWeibull:                 {1, 1.2, 3.75, 10, 17, 20.9, 21},
+		ExactLinear:                  {1, 2.8, 4.75, 10, 15.75, 20.1, 21},
+		ExactMedianUnbiased:          {1, 1.7333333333, 3.9166666667, 10, 16.3333333333, 20.6333333333, 21},
+		ExactNormalUnbiased:          {1, 1.8, 3.9375, 10, 16.25, 20.6, 21},
+	}
+
+	for m, exp := range exp {
+		e := &Exact{Method: m}
+
+		for _, v := range vals {
+			e.Insert(v)
+		}
+
+		for i, q := range qs {
+			if x := e.Query(q); math.Abs(x-exp[i]) > 1e-9 {
+				tb.Errorf("type %d: q %.2f => %v  wanted %v", m, q, x, exp[i])
+			}
+		}
+	}
+
+	// Excel: PERCENTILE.INC({1,2,3,4}, 0.25) = 1.75, PERCENTILE.EXC({1,2,3,4}, 0.25) = 1.25
+	for _, tc := range []struct {
+		m   ExactMethod
+		exp float64
+	}{
+		{ExactLinear, 1.75},
+		{ExactWeibull, 1.25},
+		{ExactIndex, 2},
+	} {
+		e := &Exact{Method: tc.m}
+
+		for _, v := range []float64{1, 2, 3, 4} {
+			e.Insert(v)
+		}
+
+		if x := e.Query(0.25); x != tc.exp {
+			tb.Errorf("type %d: q .25 => %v  wanted %v", tc.m, x, tc.exp)
+		}
+	}
+
+	e := &Exact{Method: ExactLinear}
+	e.Insert(5)
+
+	if x := e.Query(0.3); x != 5 {
+		tb.Errorf("single value: q .3 => %v", x)
+	}
+}
+
+func TestExactSelect(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, n := range []int{1, 2, 10, 17, 100, 1000, 10000} {
+		for _, dups := range []int{2, 10, n + 1} {
+			v := make([]float64, n)
+
+			for i := range v {
+				v[i] = float64(r.IntN(dups))
+			}
+
+			sorted := slices.Clone(v)
+			slices.Sort(sorted)
+
+			var ks []int
+
+			for range 1 + r.IntN(5) {
+				ks = append(ks, r.IntN(n))
+			}
+
+			slices.Sort(ks)
+			ks = slices.Compact(ks)
+
+			exactSelect(v, 0, ks, 2*n)
+
+			for _, k := range ks {
+				if v[k] != sorted[k] {
+					tb.Errorf("n %d dups %d: v[%d] = %v  wanted %v", n, dups, k, v[k], sorted[k])
+				}
+			}
+		}
+	}
+}
+
+func TestExactQueryMulti(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	qs := []float64{0.5, 0, 1, 0.1, 0.99, 0.5, 0.3, 0.01, 0.999}
+
+	for _, m := range []ExactMethod{ExactIndex, ExactInvertedCDF, ExactClosestObservation, ExactLinear, ExactNormalUnbiased} {
+		for _, n := range []int{1, 2, 3, 10, 1000} {
+			e := &Exact{Method: m}
+			s := &Exact{Method: m}
+
+			for range n {
+				v := r.NormFloat64()
+
+				e.Insert(v)
+				s.Insert(v)
+			}
+
+			e.sort()
+
+			res := make([]float64, len(qs))
+			s.QueryMulti(qs, res)
+
+			if s.sorted && n == 1000 { // 9 queries are fewer than log2(n)
+				tb.Errorf("type %d n %d: sorted for %d queries", m, n, len(qs))
+			}
+
+			for i, q := range qs {
+				if exp := e.Query(q); res[i] != exp {
+					tb.Errorf("type %d n %d: q %v => %v  wanted %v", m, n, q, res[i], exp)
+				}
+			}
+
+			for _, q := range qs {
+				if x, exp := s.Query(q), e.Query(q); x != exp {
+					tb.Errorf("type %d n %d: q %v => %v  wanted %v", m, n, q, x, exp)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkExactQuery(tb *testing.B) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	vs := make([]float64, 1e6)
+
+	for i := range vs {
+		vs[i] = r.NormFloat64()
+	}
+
+	qs := []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999}
+
+	for _, nq := range []int{1, len(qs)} {
+		for _, sorted := range []bool{false, true} {
+			tb.Run(fmt.Sprintf("Queries%d/Sort%v", nq, sorted), func(tb *testing.B) {
+				tb.ReportAllocs()
+
+				s := NewExact()
+				s.v = make([]float64, len(vs))
+
+				res := make([]float64, nq)
+
+				for i := 0; i < tb.N; i++ {
+					tb.StopTimer()
+					copy(s.v, vs)
+					s.sorted, s.queries = false, 0
+					tb.StartTimer()
+
+					if sorted {
+						s.sort()
+					}
+
+					s.QueryMulti(qs[:nq], res)
+				}
+			})
+		}
+	}
+}
+
+func TestExactWeighted(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	qs := []float64{0, 0.01, 0.1, 0.25, 0.3, 0.5, 0.7, 0.75, 0.9, 0.99, 1}
+
+	for m := ExactIndex; m <= ExactNormalUnbiased; m++ {
+		e := &Exact{Method: m} // expanded
+		s := &Exact{Method: m}
+
+		for i := range 100 {
+			v := float64(r.IntN(50))
+			w := 1 + r.IntN(4)
+
+			if i == 10 {
+				w = 1 // unit weights before and after weighted ones
+			}
+
+			for range w {
+				e.Insert(v)
+			}
+
+			s.InsertWeighted(v, float32(w))
+		}
+
+		s.InsertWeighted(1000, 0)
+
+		if s.Count() != e.Count() {
+			tb.Errorf("type %d: count %v  wanted %v", m, s.Count(), e.Count())
+		}
+
+		for _, q := range qs {
+			if x, y := s.Query(q), e.Query(q); x != y {
+				tb.Errorf("type %d: q %.2f => %v  wanted %v", m, q, x, y)
+			}
+		}
+
+		for _, v := range []float64{-1, 0, 10, 25.5, 49, 50} {
+			if x, y := s.Rank(v), e.Rank(v); x != y {
+				tb.Errorf("type %d: rank(%v) => %v  wanted %v", m, v, x, y)
+			}
+
+			if x, y := s.CDF(v), e.CDF(v); x != y {
+				tb.Errorf("type %d: cdf(%v) => %v  wanted %v", m, v, x, y)
+			}
+		}
+	}
+}
+
+func TestExactMerge(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	all := &Exact{Method: ExactLinear}
+	a := &Exact{Method: ExactLinear}
+	b := &Exact{Method: ExactLinear}
+
+	for i := range 1000 {
+		v := r.NormFloat64()
+		w := float32(1 + r.IntN(3))
+
+		if i%2 == 0 {
+			w = 1
+		}
+
+		all.InsertWeighted(v, w)
+
+		if i < 600 {
+			a.InsertWeighted(v, w)
+		} else {
+			b.InsertWeighted(v, w)
+		}
+	}
+
+	_ = a.Query(0.5)
+
+	a.Merge(b)
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		if x, y := a.Query(q), all.Query(q); x != y {
+			tb.Errorf("q %.2f => %v  wanted %v", q, x, y)
+		}
+	}
+
+	if a.Count() != all.Count() || a.Rank(0) != all.Rank(0) {
+		tb.Errorf("count %v  rank %v  wanted %v %v", a.Count(), a.Rank(0), all.Count(), all.Rank(0))
+	}
+
+	a.Reset()
+
+	if a.Count() != 0 || a.Query(0.5) != 0 || a.CDF(0) != 0 {
+		tb.Errorf("not empty after reset: %v", a.Count())
+	}
+
+	a.Insert(3)
+	a.Insert(1)
+
+	if x := a.Query(0.5); x != 2 {
+		tb.Errorf("after reset: q .5 => %v  wanted 2", x)
+	}
+}
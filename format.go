@@ -0,0 +1,215 @@
+package quantile
+
+import (
+	"encoding"
+	"fmt"
+	"strconv"
+)
+
+// Text form.
+//
+// %v prints a one line summary: count, min, p50, p99 and max.
+// %+v and MarshalText print the summary followed by parameters and all the data.
+
+type (
+	textDumper interface {
+		Sketch
+
+		appendDump(b []byte) []byte
+	}
+)
+
+var (
+	_ fmt.Formatter          = (*TDigest)(nil)
+	_ fmt.Formatter          = (*DDLog)(nil)
+	_ fmt.Formatter          = (*KLL)(nil)
+	_ fmt.Formatter          = (*Exact)(nil)
+	_ fmt.Formatter          = (*OSTree)(nil)
+	_ encoding.TextMarshaler = (*TDigest)(nil)
+	_ encoding.TextMarshaler = (*DDLog)(nil)
+	_ encoding.TextMarshaler = (*KLL)(nil)
+	_ encoding.TextMarshaler = (*Exact)(nil)
+	_ encoding.TextMarshaler = (*OSTree)(nil)
+)
+
+// Format implements fmt.Formatter.
+func (s *TDigest) Format(f fmt.State, verb rune) { textFormat(f, verb, s) }
+
+// MarshalText implements encoding.TextMarshaler, it's the same as %+v.
+func (s *TDigest) MarshalText() ([]byte, error) { return textAppend(nil, s), nil }
+
+// Format implements fmt.Formatter.
+func (s *DDLog) Format(f fmt.State, verb rune) { textFormat(f, verb, s) }
+
+// MarshalText implements encoding.TextMarshaler, it's the same as %+v.
+func (s *DDLog) MarshalText() ([]byte, error) { return textAppend(nil, s), nil }
+
+// Format implements fmt.Formatter.
+func (s *KLL) Format(f fmt.State, verb rune) { textFormat(f, verb, s) }
+
+// MarshalText implements encoding.TextMarshaler, it's the same as %+v.
+func (s *KLL) MarshalText() ([]byte, error) { return textAppend(nil, s), nil }
+
+// Format implements fmt.Formatter.
+func (s *Exact) Format(f fmt.State, verb rune) { textFormat(f, verb, s) }
+
+// MarshalText implements encoding.TextMarshaler, it's the same as %+v.
+func (s *Exact) MarshalText() ([]byte, error) { return textAppend(nil, s), nil }
+
+// Format implements fmt.Formatter.
+func (s *OSTree) Format(f fmt.State, verb rune) { textFormat(f, verb, s) }
+
+// MarshalText implements encoding.TextMarshaler, it's the same as %+v.
+func (s *OSTree) MarshalText() ([]byte, error) { return textAppend(nil, s), nil }
+
+func (s *TDigest) appendDump(b []byte) []byte {
+	inv := "func"
+	var eps float32
+
+	switch x := s.Invariant.(type) {
+	case HighBias:
+		inv, eps = jsonInvariants[binHighBias], float32(x)
+	case LowBias:
+		inv, eps = jsonInvariants[binLowBias], float32(x)
+	case ExtremesBias:
+		inv, eps = jsonInvariants[binExtremesBias], float32(x)
+	}
+
+	if !s.sorted {
+		s.sort()
+	}
+
+	b = fmt.Appendf(b, "invariant=%s eps=%v decay=%v size=%d centroids=%d\n", inv, eps, s.Decay, s.size, s.i)
+
+	for i := range s.i {
+		b = fmt.Appendf(b, "  %v %v\n", s.v[i], s.w[i])
+	}
+
+	return b
+}
+
+func (s *DDLog) appendDump(b []byte) []byte {
+	kind := s.pos.kind()
+
+	mapping := fmt.Sprintf("%T", s.m)
+
+	if gamma, offset, interp, err := ddMappingParams(s.m); err == nil {
+		mapping = fmt.Sprintf("%s gamma=%v offset=%v", jsonMappings[interp], gamma, offset)
+	}
+
+	collapse := strconv.Itoa(int(s.Collapse))
+
+	if s.Collapse >= CollapseLowest && s.Collapse <= CollapseHighest {
+		collapse = jsonCollapses[s.Collapse]
+	}
+
+	b = fmt.Appendf(b, "mapping=%s store=%s counts=%s max_bins=%d collapse=%s\n",
+		mapping, jsonStores[kind&ddKindMask], jsonCounts[kind&ddCountsMask>>4], s.MaxBins, collapse)
+	b = fmt.Appendf(b, "zeros=%v sum=%v\n", s.zeros, s.sum)
+
+	b = s.appendDumpStore(b, "neg", s.neg)
+	b = s.appendDumpStore(b, "pos", s.pos)
+
+	return b
+}
+
+func (s *DDLog) appendDumpStore(b []byte, name string, st ddstore) []byte {
+	n := 0
+	st.each(func(int, float64) { n++ })
+
+	b = fmt.Appendf(b, "%s bins=%d", name, n)
+
+	if ckey, ok := st.collapsedKey(); ok {
+		b = fmt.Appendf(b, " collapsed=%d", ckey)
+	}
+
+	b = append(b, '\n')
+
+	st.each(func(key int, w float64) {
+		b = fmt.Appendf(b, "  %d %v %v\n", key, s.unkey(key), w)
+	})
+
+	return b
+}
+
+func (s *KLL) appendDump(b []byte) []byte {
+	b = fmt.Appendf(b, "width=%d depth=%d\n", s.width, s.depth)
+
+	for l := range s.depth {
+		st, end := s.startEnd(l)
+
+		if !s.s[l] {
+			s.sort(st, end)
+			s.s[l] = true
+		}
+
+		b = fmt.Appendf(b, "level %d: %v\n", l, s.v[st:end])
+	}
+
+	return b
+}
+
+func (s *Exact) appendDump(b []byte) []byte {
+	if !s.sorted {
+		s.sort()
+	}
+
+	b = fmt.Appendf(b, "method=%d\n", s.Method)
+	b = fmt.Appendf(b, "values: %v\n", s.v)
+
+	if s.w != nil {
+		b = fmt.Appendf(b, "weights: %v\n", s.w)
+	}
+
+	return b
+}
+
+func (s *OSTree) appendDump(b []byte) []byte {
+	vs := make([]float64, int(s.Count()))
+
+	for k := range vs {
+		vs[k] = s.Select(k)
+	}
+
+	return fmt.Appendf(b, "values: %v\n", vs)
+}
+
+func textFormat(f fmt.State, verb rune, s textDumper) {
+	var b []byte
+
+	switch {
+	case verb == 'v' && f.Flag('+'):
+		b = textAppend(b, s)
+	case verb == 'v' || verb == 's':
+		b = textAppendSummary(b, s)
+	default:
+		b = fmt.Appendf(b, "%%!%c(%T)", verb, s)
+	}
+
+	_, _ = f.Write(b)
+}
+
+func textAppend(b []byte, s textDumper) []byte {
+	b = textAppendSummary(b, s)
+	b = append(b, '\n')
+
+	return s.appendDump(b)
+}
+
+func textAppendSummary(b []byte, s Sketch) []byte {
+	var res [4]float64
+
+	s.QueryMulti([]float64{0, 0.5, 0.99, 1}, res[:])
+
+	b = append(b, "count="...)
+	b = strconv.AppendFloat(b, s.Count(), 'g', -1, 64)
+
+	for i, name := range []string{"min", "p50", "p99", "max"} {
+		b = append(b, ' ')
+		b = append(b, name...)
+		b = append(b, '=')
+		b = strconv.AppendFloat(b, res[i], 'g', 4, 64)
+	}
+
+	return b
+}
@@ -0,0 +1,645 @@
+package quantile
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// JSON encoding.
+//
+// Parameters are named fields, centroids, bins and levels are arrays.
+// Centroids are [mean, weight] pairs, bins are [key, count] pairs.
+// Floats are numbers, infinities and NaN are strings "+Inf", "-Inf" and "NaN".
+
+type (
+	// jsonFloat is a float which can be infinite, which JSON numbers can't.
+	jsonFloat float64
+
+	// jsonCentroid is [mean, weight] pair.
+	jsonCentroid struct {
+		m float64
+		w float32
+	}
+
+	// jsonBin is [key, count] pair.
+	jsonBin struct {
+		key int
+		w   float64
+	}
+
+	tdigestJSON struct {
+		Invariant string         `json:"invariant"`
+		Eps       float32        `json:"eps"`
+		Decay     float32        `json:"decay"`
+		Size      int            `json:"size"`
+		Centroids []jsonCentroid `json:"centroids"`
+	}
+
+	ddlogJSON struct {
+		Mapping  string      `json:"mapping"`
+		Gamma    float64     `json:"gamma"`
+		Offset   float64     `json:"offset"`
+		Store    string      `json:"store"`
+		Counts   string      `json:"counts"`
+		MaxBins  int         `json:"max_bins"`
+		Collapse string      `json:"collapse"`
+		Zeros    jsonFloat   `json:"zeros"`
+		Min      jsonFloat   `json:"min"`
+		Max      jsonFloat   `json:"max"`
+		Sum      jsonFloat   `json:"sum"`
+		Pos      ddstoreJSON `json:"pos"`
+		Neg      ddstoreJSON `json:"neg"`
+	}
+
+	ddstoreJSON struct {
+		Collapsed *int      `json:"collapsed,omitempty"`
+		Bins      []jsonBin `json:"bins"`
+	}
+
+	kllJSON struct {
+		Width  int           `json:"width"`
+		Depth  int           `json:"depth"`
+		Count  jsonFloat     `json:"count"`
+		Levels [][]jsonFloat `json:"levels"`
+	}
+
+	exactJSON struct {
+		Method  ExactMethod `json:"method"`
+		Values  []jsonFloat `json:"values"`
+		Weights []float32   `json:"weights,omitempty"`
+	}
+
+	ostreeJSON struct {
+		Values []jsonFloat `json:"values"`
+	}
+)
+
+var (
+	_ json.Marshaler   = (*TDigest)(nil)
+	_ json.Unmarshaler = (*TDigest)(nil)
+	_ json.Marshaler   = (*DDLog)(nil)
+	_ json.Unmarshaler = (*DDLog)(nil)
+	_ json.Marshaler   = (*KLL)(nil)
+	_ json.Unmarshaler = (*KLL)(nil)
+	_ json.Marshaler   = (*Exact)(nil)
+	_ json.Unmarshaler = (*Exact)(nil)
+	_ json.Marshaler   = (*OSTree)(nil)
+	_ json.Unmarshaler = (*OSTree)(nil)
+)
+
+var (
+	jsonInvariants = []string{binHighBias: "high", binLowBias: "low", binExtremesBias: "extremes"}
+	jsonMappings   = []string{ddInterpolationNone: "log", ddInterpolationLinear: "linear", ddInterpolationCubic: "cubic"}
+	jsonStores     = []string{DDDense: "dense", DDSparse: "sparse"}
+	jsonCounts     = []string{DDFloat32 >> 4: "float32", DDFloat64 >> 4: "float64", DDUint64 >> 4: "uint64"}
+	jsonCollapses  = []string{CollapseLowest: "lowest", CollapseHighest: "highest"}
+)
+
+// MarshalJSON implements json.Marshaler.
+// Centroids are sorted in place.
+// Only HighBias, LowBias and ExtremesBias invariants are supported.
+func (s *TDigest) MarshalJSON() ([]byte, error) {
+	var kind int
+	var eps float32
+
+	switch inv := s.Invariant.(type) {
+	case HighBias:
+		kind, eps = binHighBias, float32(inv)
+	case LowBias:
+		kind, eps = binLowBias, float32(inv)
+	case ExtremesBias:
+		kind, eps = binExtremesBias, float32(inv)
+	default:
+		return nil, ErrUnsupportedInvariant
+	}
+
+	if !s.sorted {
+		s.sort()
+	}
+
+	x := tdigestJSON{
+		Invariant: jsonInvariants[kind],
+		Eps:       eps,
+		Decay:     s.Decay,
+		Size:      s.size,
+		Centroids: make([]jsonCentroid, s.i),
+	}
+
+	for i := range s.i {
+		x.Centroids[i] = jsonCentroid{m: s.v[i], w: s.w[i]}
+	}
+
+	return json.Marshal(x)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// s is replaced by the decoded sketch.
+func (s *TDigest) UnmarshalJSON(p []byte) error {
+	var x tdigestJSON
+
+	err := json.Unmarshal(p, &x)
+	if err != nil {
+		return err
+	}
+
+	var inv Invariant
+
+	switch jsonIndex(jsonInvariants, x.Invariant) {
+	case binHighBias:
+		inv = HighBias(x.Eps)
+	case binLowBias:
+		inv = LowBias(x.Eps)
+	case binExtremesBias:
+		inv = ExtremesBias(x.Eps)
+	default:
+		return ErrUnsupportedInvariant
+	}
+
+	if x.Size <= 0 || x.Size%2 != 0 || x.Size > binMaxAlloc || len(x.Centroids) > x.Size {
+		return ErrMalformed
+	}
+
+	d := NewTD(inv, x.Size)
+	d.Decay = x.Decay
+
+	for i, c := range x.Centroids {
+		if math.IsNaN(c.m) || !(c.w >= 0) {
+			return ErrMalformed
+		}
+
+		d.v[i], d.w[i] = c.m, c.w
+	}
+
+	d.i = len(x.Centroids)
+	d.sorted = slices.IsSorted(d.v[:d.i])
+
+	*s = *d
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+// Bins, stats and MaxBins and Collapse settings are encoded.
+func (s *DDLog) MarshalJSON() ([]byte, error) {
+	gamma, offset, interp, err := ddMappingParams(s.m)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Collapse < CollapseLowest || s.Collapse > CollapseHighest {
+		return nil, ErrMalformed
+	}
+
+	kind := s.pos.kind()
+
+	x := ddlogJSON{
+		Mapping:  jsonMappings[interp],
+		Gamma:    gamma,
+		Offset:   offset,
+		Store:    jsonStores[kind&ddKindMask],
+		Counts:   jsonCounts[kind&ddCountsMask>>4],
+		MaxBins:  max(s.MaxBins, 0),
+		Collapse: jsonCollapses[s.Collapse],
+		Zeros:    jsonFloat(s.zeros),
+		Min:      jsonFloat(s.min),
+		Max:      jsonFloat(s.max),
+		Sum:      jsonFloat(s.sum),
+		Pos:      jsonStore(s.pos),
+		Neg:      jsonStore(s.neg),
+	}
+
+	return json.Marshal(x)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// s data, mapping, store kind, MaxBins and Collapse are replaced,
+// other settings are preserved.
+func (s *DDLog) UnmarshalJSON(p []byte) error {
+	var x ddlogJSON
+
+	err := json.Unmarshal(p, &x)
+	if err != nil {
+		return err
+	}
+
+	interp := jsonIndex(jsonMappings, x.Mapping)
+	if interp < 0 {
+		return ErrUnsupportedMapping
+	}
+
+	m, err := ddMapping(x.Gamma, x.Offset, uint64(interp))
+	if err != nil {
+		return err
+	}
+
+	store := jsonIndex(jsonStores, x.Store)
+	counts := jsonIndex(jsonCounts, x.Counts)
+	collapse := jsonIndex(jsonCollapses, x.Collapse)
+
+	if store < 0 || counts < 0 || collapse < 0 || x.MaxBins < 0 || x.MaxBins > math.MaxInt32 ||
+		!binIsCount(float64(x.Zeros)) || math.IsNaN(float64(x.Min)) || math.IsNaN(float64(x.Max)) || math.IsNaN(float64(x.Sum)) {
+		return ErrMalformed
+	}
+
+	d := NewDDLogMapping(m, DDStore(store)|DDStore(counts)<<4)
+	d.MaxBins = x.MaxBins
+	d.Collapse = DDCollapse(collapse)
+	d.ShrinkBins = s.ShrinkBins
+	d.Interpolate = s.Interpolate
+
+	d.zeros = float64(x.Zeros)
+	d.min = float64(x.Min)
+	d.max = float64(x.Max)
+	d.sum = float64(x.Sum)
+
+	err = jsonDecodeStore(d.pos, x.Pos)
+	if err != nil {
+		return err
+	}
+
+	err = jsonDecodeStore(d.neg, x.Neg)
+	if err != nil {
+		return err
+	}
+
+	*s = *d
+
+	return nil
+}
+
+func jsonStore(st ddstore) (x ddstoreJSON) {
+	if ckey, ok := st.collapsedKey(); ok {
+		x.Collapsed = &ckey
+	}
+
+	x.Bins = []jsonBin{}
+
+	st.each(func(key int, w float64) {
+		x.Bins = append(x.Bins, jsonBin{key: key, w: w})
+	})
+
+	return x
+}
+
+func jsonDecodeStore(st ddstore, x ddstoreJSON) error {
+	lo, hi := math.MaxInt, math.MinInt
+
+	for _, b := range x.Bins {
+		if b.key < math.MinInt32 || b.key > math.MaxInt32 || b.w == 0 || !binIsCount(b.w) {
+			return ErrMalformed
+		}
+
+		lo, hi = min(lo, b.key), max(hi, b.key)
+	}
+
+	if len(x.Bins) != 0 && st.kind()&ddKindMask == DDDense {
+		if hi-lo >= binMaxAlloc {
+			return ErrMalformed
+		}
+
+		st.reserve(lo, hi, 0)
+	}
+
+	for _, b := range x.Bins {
+		st.add(b.key, b.w, 0)
+	}
+
+	if x.Collapsed != nil {
+		if *x.Collapsed < math.MinInt32 || *x.Collapsed > math.MaxInt32 {
+			return ErrMalformed
+		}
+
+		st.markCollapsed(*x.Collapsed)
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+// Levels are sorted in place.
+func (s *KLL) MarshalJSON() ([]byte, error) {
+	x := kllJSON{
+		Width:  s.width,
+		Depth:  s.depth,
+		Count:  jsonFloat(s.n),
+		Levels: make([][]jsonFloat, s.depth),
+	}
+
+	for l := range s.depth {
+		st, end := s.startEnd(l)
+
+		if !s.s[l] {
+			s.sort(st, end)
+			s.s[l] = true
+		}
+
+		x.Levels[l] = jsonFloats(s.v[st:end])
+	}
+
+	return json.Marshal(x)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// s is replaced by the decoded sketch.
+func (s *KLL) UnmarshalJSON(p []byte) error {
+	var x kllJSON
+
+	err := json.Unmarshal(p, &x)
+	if err != nil {
+		return err
+	}
+
+	if x.Width <= 0 || x.Width%2 != 0 || x.Depth <= 0 || x.Width > binMaxAlloc/x.Depth ||
+		len(x.Levels) > x.Depth || !(x.Count >= 0) {
+		return ErrMalformed
+	}
+
+	k := NewKLL(x.Width, x.Depth)
+	k.n = float64(x.Count)
+
+	for l, vs := range x.Levels {
+		if len(vs) > x.Width {
+			return ErrMalformed
+		}
+
+		k.l[l] = len(vs)
+
+		st, end := k.startEnd(l)
+
+		err = jsonValues(k.v[st:end], vs)
+		if err != nil {
+			return err
+		}
+
+		k.s[l] = slices.IsSorted(k.v[st:end])
+	}
+
+	*s = *k
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+// Values are sorted in place.
+func (s *Exact) MarshalJSON() ([]byte, error) {
+	if !s.sorted {
+		s.sort()
+	}
+
+	x := exactJSON{
+		Method:  s.Method,
+		Values:  jsonFloats(s.v),
+		Weights: s.w,
+	}
+
+	return json.Marshal(x)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// s is replaced by the decoded values.
+func (s *Exact) UnmarshalJSON(p []byte) error {
+	var x exactJSON
+
+	err := json.Unmarshal(p, &x)
+	if err != nil {
+		return err
+	}
+
+	if x.Method < ExactIndex || x.Method > ExactNormalUnbiased || x.Weights != nil && len(x.Weights) != len(x.Values) {
+		return ErrMalformed
+	}
+
+	e := &Exact{
+		v:      make([]float64, len(x.Values)),
+		w:      x.Weights,
+		Method: x.Method,
+	}
+
+	err = jsonValues(e.v, x.Values)
+	if err != nil {
+		return err
+	}
+
+	if e.w != nil {
+		for _, w := range e.w {
+			if !(w > 0) {
+				return ErrMalformed
+			}
+
+			e.total += float64(w)
+		}
+	} else {
+		e.total = float64(len(e.v))
+	}
+
+	e.sorted = slices.IsSorted(e.v)
+
+	*s = *e
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *OSTree) MarshalJSON() ([]byte, error) {
+	x := ostreeJSON{
+		Values: make([]jsonFloat, int(s.Count())),
+	}
+
+	for k := range x.Values {
+		x.Values[k] = jsonFloat(s.Select(k))
+	}
+
+	return json.Marshal(x)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// s values are replaced by the decoded ones.
+func (s *OSTree) UnmarshalJSON(p []byte) error {
+	var x ostreeJSON
+
+	err := json.Unmarshal(p, &x)
+	if err != nil {
+		return err
+	}
+
+	t := &OSTree{}
+
+	for _, v := range x.Values {
+		if math.IsNaN(float64(v)) {
+			return ErrMalformed
+		}
+
+		t.Insert(float64(v))
+	}
+
+	*s = *t
+
+	return nil
+}
+
+func jsonFloats(vs []float64) []jsonFloat {
+	r := make([]jsonFloat, len(vs))
+
+	for i, v := range vs {
+		r[i] = jsonFloat(v)
+	}
+
+	return r
+}
+
+func jsonValues(dst []float64, vs []jsonFloat) error {
+	for i, v := range vs {
+		if math.IsNaN(float64(v)) {
+			return ErrMalformed
+		}
+
+		dst[i] = float64(v)
+	}
+
+	return nil
+}
+
+// jsonIndex returns the index of name in names or -1.
+func jsonIndex(names []string, name string) int {
+	if name == "" {
+		return -1
+	}
+
+	return slices.Index(names, name)
+}
+
+func (x jsonFloat) MarshalJSON() ([]byte, error) {
+	return jsonAppendFloat(nil, float64(x), 64), nil
+}
+
+func (x *jsonFloat) UnmarshalJSON(p []byte) error {
+	v, err := jsonParseFloat(p, 64)
+	if err != nil {
+		return err
+	}
+
+	*x = jsonFloat(v)
+
+	return nil
+}
+
+func (c jsonCentroid) MarshalJSON() ([]byte, error) {
+	b := append([]byte{}, '[')
+	b = jsonAppendFloat(b, c.m, 64)
+	b = append(b, ',')
+	b = jsonAppendFloat(b, float64(c.w), 32)
+	b = append(b, ']')
+
+	return b, nil
+}
+
+func (c *jsonCentroid) UnmarshalJSON(p []byte) error {
+	var x [2]json.RawMessage
+
+	err := jsonPair(p, &x)
+	if err != nil {
+		return err
+	}
+
+	m, err := jsonParseFloat(x[0], 64)
+	if err != nil {
+		return err
+	}
+
+	w, err := jsonParseFloat(x[1], 32)
+	if err != nil {
+		return err
+	}
+
+	*c = jsonCentroid{m: m, w: float32(w)}
+
+	return nil
+}
+
+func (b jsonBin) MarshalJSON() ([]byte, error) {
+	p := append([]byte{}, '[')
+	p = strconv.AppendInt(p, int64(b.key), 10)
+	p = append(p, ',')
+	p = jsonAppendFloat(p, b.w, 64)
+	p = append(p, ']')
+
+	return p, nil
+}
+
+func (b *jsonBin) UnmarshalJSON(p []byte) error {
+	var x [2]json.RawMessage
+
+	err := jsonPair(p, &x)
+	if err != nil {
+		return err
+	}
+
+	key, err := strconv.ParseInt(string(x[0]), 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	w, err := jsonParseFloat(x[1], 64)
+	if err != nil {
+		return err
+	}
+
+	*b = jsonBin{key: int(key), w: w}
+
+	return nil
+}
+
+// jsonPair decodes exactly two elements array.
+func jsonPair(p []byte, x *[2]json.RawMessage) error {
+	var r []json.RawMessage
+
+	err := json.Unmarshal(p, &r)
+	if err != nil {
+		return err
+	}
+
+	if len(r) != 2 {
+		return ErrMalformed
+	}
+
+	*x = [2]json.RawMessage(r)
+
+	return nil
+}
+
+func jsonAppendFloat(b []byte, v float64, size int) []byte {
+	switch {
+	case math.IsInf(v, 1):
+		return append(b, `"+Inf"`...)
+	case math.IsInf(v, -1):
+		return append(b, `"-Inf"`...)
+	case math.IsNaN(v):
+		return append(b, `"NaN"`...)
+	}
+
+	return strconv.AppendFloat(b, v, 'g', -1, size)
+}
+
+func jsonParseFloat(p []byte, size int) (float64, error) {
+	s := string(p)
+
+	switch s {
+	case `"+Inf"`:
+		return math.Inf(1), nil
+	case `"-Inf"`:
+		return math.Inf(-1), nil
+	case `"NaN"`:
+		return math.NaN(), nil
+	case "null":
+		return 0, ErrMalformed
+	}
+
+	v, err := strconv.ParseFloat(s, size)
+	if err != nil {
+		return 0, ErrMalformed
+	}
+
+	return v, nil
+}
@@ -0,0 +1,167 @@
+package quantile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(tb *testing.T) {
+	for name, s := range binarySketches() {
+		tb.Run(name, func(tb *testing.T) {
+			data, err := json.Marshal(s)
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			s1 := newZeroSketch(s)
+
+			err = json.Unmarshal(data, s1)
+			if err != nil {
+				tb.Fatalf("unmarshal: %v\n%s", err, data)
+			}
+
+			// binary encoding covers all the state
+			bin, err := s.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal binary: %v", err)
+			}
+
+			bin1, err := s1.MarshalBinary()
+			if err != nil {
+				tb.Fatalf("marshal binary: %v", err)
+			}
+
+			if !bytes.Equal(bin, bin1) {
+				tb.Errorf("decoded differently\n%s", data)
+			}
+
+			data1, err := json.Marshal(s1)
+			if err != nil {
+				tb.Fatalf("marshal: %v", err)
+			}
+
+			if !bytes.Equal(data, data1) {
+				tb.Errorf("encoding differs after round trip")
+			}
+		})
+	}
+}
+
+func TestJSONInf(tb *testing.T) {
+	s := NewDDLog(0.01)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		tb.Fatalf("marshal empty: %v", err)
+	}
+
+	if !bytes.Contains(data, []byte(`"min":"+Inf","max":"-Inf"`)) {
+		tb.Errorf("empty: %s", data)
+	}
+
+	e := NewExact()
+	e.Insert(math.Inf(-1))
+	e.Insert(1.5)
+
+	data, err = json.Marshal(e)
+	if err != nil {
+		tb.Fatalf("marshal inf: %v", err)
+	}
+
+	if want := `{"method":0,"values":["-Inf",1.5]}`; string(data) != want {
+		tb.Errorf("inf: %s, want %s", data, want)
+	}
+
+	var e1 Exact
+
+	err = json.Unmarshal(data, &e1)
+	if err != nil {
+		tb.Fatalf("unmarshal: %v", err)
+	}
+
+	if q := e1.Query(0); !math.IsInf(q, -1) {
+		tb.Errorf("query: %v", q)
+	}
+}
+
+func TestJSONErrors(tb *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    json.Unmarshaler
+		data string
+		err  error
+	}{
+		{"tdigest_invariant", &TDigest{}, `{"invariant":"func","eps":0.01,"size":16}`, ErrUnsupportedInvariant},
+		{"tdigest_size", &TDigest{}, `{"invariant":"low","eps":0.01,"size":3}`, ErrMalformed},
+		{"tdigest_centroids", &TDigest{}, `{"invariant":"low","eps":0.01,"size":2,"centroids":[[1,1],[2,1],[3,1]]}`, ErrMalformed},
+		{"tdigest_pair", &TDigest{}, `{"invariant":"low","eps":0.01,"size":2,"centroids":[[1]]}`, ErrMalformed},
+		{"tdigest_nan", &TDigest{}, `{"invariant":"low","eps":0.01,"size":2,"centroids":[["NaN",1]]}`, ErrMalformed},
+		{"tdigest_weight", &TDigest{}, `{"invariant":"low","eps":0.01,"size":2,"centroids":[[1,-1]]}`, ErrMalformed},
+		{"tdigest_weight_nan", &TDigest{}, `{"invariant":"low","eps":0.01,"size":2,"centroids":[[1,"NaN"]]}`, ErrMalformed},
+		{"ddlog_mapping", &DDLog{}, `{"mapping":"quadratic","gamma":1.02,"store":"dense","counts":"float32","collapse":"lowest"}`, ErrUnsupportedMapping},
+		{"ddlog_gamma", &DDLog{}, `{"mapping":"log","gamma":1,"store":"dense","counts":"float32","collapse":"lowest"}`, ErrMalformed},
+		{"ddlog_store", &DDLog{}, `{"mapping":"log","gamma":1.02,"store":"tree","counts":"float32","collapse":"lowest"}`, ErrMalformed},
+		{"ddlog_count", &DDLog{}, `{"mapping":"log","gamma":1.02,"store":"dense","counts":"float32","collapse":"lowest","pos":{"bins":[[1,-1]]}}`, ErrMalformed},
+		{"ddlog_count_inf", &DDLog{}, `{"mapping":"log","gamma":1.02,"store":"dense","counts":"float32","collapse":"lowest","pos":{"bins":[[1,"+Inf"]]}}`, ErrMalformed},
+		{"ddlog_zeros_inf", &DDLog{}, `{"mapping":"log","gamma":1.02,"store":"dense","counts":"float32","collapse":"lowest","zeros":"+Inf"}`, ErrMalformed},
+		{"ddlog_span", &DDLog{}, `{"mapping":"log","gamma":1.02,"store":"dense","counts":"float32","collapse":"lowest","pos":{"bins":[[-2000000000,1],[2000000000,1]]}}`, ErrMalformed},
+		{"kll_width", &KLL{}, `{"width":3,"depth":2}`, ErrMalformed},
+		{"kll_level", &KLL{}, `{"width":2,"depth":2,"levels":[[1,2,3]]}`, ErrMalformed},
+		{"exact_weights", &Exact{}, `{"method":0,"values":[1,2],"weights":[1]}`, ErrMalformed},
+		{"exact_weight", &Exact{}, `{"method":0,"values":[1,2],"weights":[1,0]}`, ErrMalformed},
+		{"exact_weight_negative", &Exact{}, `{"method":0,"values":[1,2],"weights":[1,-2]}`, ErrMalformed},
+		{"exact_method", &Exact{}, `{"method":10,"values":[1]}`, ErrMalformed},
+		{"ostree_nan", &OSTree{}, `{"values":["NaN"]}`, ErrMalformed},
+		{"ostree_float", &OSTree{}, `{"values":["1"]}`, ErrMalformed},
+	} {
+		err := json.Unmarshal([]byte(tc.data), tc.s)
+		if !errors.Is(err, tc.err) {
+			tb.Errorf("%v: %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestFormat(tb *testing.T) {
+	s := NewExact()
+
+	for i := range 100 {
+		s.Insert(float64(100 - i))
+	}
+
+	if x, want := fmt.Sprintf("%v", s), "count=100 min=1 p50=51 p99=100 max=100"; x != want {
+		tb.Errorf("summary: %q, want %q", x, want)
+	}
+
+	if x, want := fmt.Sprintf("%d", s), "%!d(*quantile.Exact)"; x != want {
+		tb.Errorf("bad verb: %q, want %q", x, want)
+	}
+
+	full := fmt.Sprintf("%+v", s)
+
+	text, err := s.MarshalText()
+	if err != nil {
+		tb.Fatalf("marshal text: %v", err)
+	}
+
+	if string(text) != full {
+		tb.Errorf("text differs from %%+v\n%s\n%s", text, full)
+	}
+
+	if !strings.HasPrefix(full, "count=100 min=1 p50=51 p99=100 max=100\nmethod=0\nvalues: [1 2 3 ") {
+		tb.Errorf("full dump: %s", full)
+	}
+
+	for name, s := range binarySketches() {
+		sum := fmt.Sprintf("%v", s)
+		full := fmt.Sprintf("%+v", s)
+
+		if strings.Contains(sum, "\n") || !strings.HasPrefix(full, sum+"\n") {
+			tb.Errorf("%v: summary %q\n%s", name, sum, full)
+		}
+	}
+}
@@ -15,6 +15,8 @@ type (
 		s []bool
 
 		width, depth int
+
+		n float64
 	}
 )
 
@@ -64,6 +66,39 @@ func (s *KLL) Query(q float64) float64 {
 	return lo + (hi-lo)*q
 }
 
+// QueryMulti makes multiple queries at once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+func (s *KLL) QueryMulti(qs, res []float64) {
+	for i, q := range qs {
+		res[i] = s.Query(q)
+	}
+}
+
+// Rank returns the estimated number of values less than or equal to v.
+func (s *KLL) Rank(v float64) float64 {
+	if s.l[0] == 0 || math.IsNaN(v) {
+		return 0
+	}
+
+	_, _, n := s.preQuery()
+
+	r, _ := s.rank(math.Nextafter(v, math.Inf(1)), v)
+
+	return float64(r) / float64(n) * s.n
+}
+
+// Count returns the number of inserted values.
+func (s *KLL) Count() float64 {
+	return s.n
+}
+
+// Reset removes all the values.
+func (s *KLL) Reset() {
+	clear(s.l)
+	clear(s.s)
+	s.n = 0
+}
+
 func (s *KLL) rank(v, hi float64) (r int, x float64) {
 	var xok bool
 
@@ -145,6 +180,15 @@ func (s *KLL) Insert(v float64) {
 
 	s.v[s.l[0]] = v
 	s.l[0]++
+	s.n++
+}
+
+// InsertWeighted inserts v w times.
+// w must be a whole number up to MaxRepeats, other weights are ignored.
+func (s *KLL) InsertWeighted(v float64, w float32) {
+	for range repeats(w) {
+		s.Insert(v)
+	}
 }
 
 func (s *KLL) compact(l int) {
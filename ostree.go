@@ -0,0 +1,312 @@
+package quantile
+
+import "math"
+
+type (
+	// OSTree is an order-statistic tree keeping all the values exactly.
+	// Insert, Remove, Query and Rank take O(log n) expected time.
+	//
+	// It's a treap with subtree sizes, nodes are kept in a slice.
+	OSTree struct {
+		nodes []osnode // nodes[0] is the nil node
+		root  int32
+		free  int32 // free nodes list linked by left
+
+		rnd uint64
+	}
+
+	osnode struct {
+		v    float64
+		prio uint32
+		size int32
+
+		left, right int32
+	}
+
+	// MovingMedian is the median of the last window values.
+	MovingMedian struct {
+		t OSTree
+
+		ring []float64
+		i    int
+	}
+)
+
+func NewOSTree() *OSTree {
+	return &OSTree{}
+}
+
+// Query returns sorted[int(q*n)] for n values in the tree.
+func (s *OSTree) Query(q float64) float64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+
+	k := min(max(int(q*n), 0), int(n)-1)
+
+	return s.Select(k)
+}
+
+// QueryMulti makes multiple queries at once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+func (s *OSTree) QueryMulti(qs, res []float64) {
+	for i, q := range qs {
+		res[i] = s.Query(q)
+	}
+}
+
+// Select returns k-th (0-based) smallest value.
+func (s *OSTree) Select(k int) float64 {
+	t := s.root
+
+	for t != 0 {
+		l := int(s.nodes[s.nodes[t].left].size)
+
+		switch {
+		case k < l:
+			t = s.nodes[t].left
+		case k == l:
+			return s.nodes[t].v
+		default:
+			k -= l + 1
+			t = s.nodes[t].right
+		}
+	}
+
+	return math.NaN()
+}
+
+// Rank returns the number of values less than or equal to v.
+func (s *OSTree) Rank(v float64) float64 {
+	var rank int32
+
+	t := s.root
+
+	for t != 0 {
+		n := &s.nodes[t]
+
+		if v < n.v {
+			t = n.left
+			continue
+		}
+
+		rank += s.nodes[n.left].size + 1
+		t = n.right
+	}
+
+	return float64(rank)
+}
+
+// CDF returns the fraction of values less than or equal to v.
+func (s *OSTree) CDF(v float64) float64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+
+	return s.Rank(v) / n
+}
+
+func (s *OSTree) Count() float64 {
+	if len(s.nodes) == 0 {
+		return 0
+	}
+
+	return float64(s.nodes[s.root].size)
+}
+
+func (s *OSTree) Insert(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+
+	if len(s.nodes) == 0 {
+		s.nodes = append(s.nodes, osnode{})
+	}
+
+	n := s.alloc(v)
+
+	l, r := s.split(s.root, v, false)
+	s.root = s.merge(s.merge(l, n), r)
+}
+
+// InsertWeighted inserts v w times.
+// w must be a whole number up to MaxRepeats, other weights are ignored.
+func (s *OSTree) InsertWeighted(v float64, w float32) {
+	for range repeats(w) {
+		s.Insert(v)
+	}
+}
+
+// Remove removes one instance of v.
+// It reports whether v was found.
+func (s *OSTree) Remove(v float64) bool {
+	if s.Count() == 0 {
+		return false
+	}
+
+	l, r := s.split(s.root, v, false)
+	m, r := s.split(r, v, true)
+
+	found := m != 0
+
+	if found {
+		n := m
+		m = s.merge(s.nodes[n].left, s.nodes[n].right)
+
+		s.nodes[n] = osnode{left: s.free}
+		s.free = n
+	}
+
+	s.root = s.merge(s.merge(l, m), r)
+
+	return found
+}
+
+// Reset removes all the values keeping the allocated memory.
+func (s *OSTree) Reset() {
+	if len(s.nodes) == 0 {
+		return
+	}
+
+	s.nodes = s.nodes[:1]
+	s.root = 0
+	s.free = 0
+}
+
+func (s *OSTree) alloc(v float64) int32 {
+	s.rnd ^= s.rnd << 13
+	s.rnd ^= s.rnd >> 7
+	s.rnd ^= s.rnd << 17
+
+	if s.rnd == 0 {
+		s.rnd = 0x9e3779b97f4a7c15
+	}
+
+	n := osnode{v: v, prio: uint32(s.rnd >> 32), size: 1}
+
+	if s.free != 0 {
+		i := s.free
+		s.free = s.nodes[i].left
+		s.nodes[i] = n
+
+		return i
+	}
+
+	s.nodes = append(s.nodes, n)
+
+	return int32(len(s.nodes) - 1)
+}
+
+// split splits t into values less than v and the rest.
+// If incl, the left part gets values less than or equal to v.
+func (s *OSTree) split(t int32, v float64, incl bool) (l, r int32) {
+	if t == 0 {
+		return 0, 0
+	}
+
+	n := &s.nodes[t]
+
+	if n.v < v || incl && n.v == v {
+		l, r = s.split(n.right, v, incl)
+
+		n.right = l
+		s.fix(t)
+
+		return t, r
+	}
+
+	l, r = s.split(n.left, v, incl)
+
+	n.left = r
+	s.fix(t)
+
+	return l, t
+}
+
+// merge joins l and r, all l values must be not greater than r ones.
+func (s *OSTree) merge(l, r int32) int32 {
+	switch {
+	case l == 0:
+		return r
+	case r == 0:
+		return l
+	}
+
+	if s.nodes[l].prio > s.nodes[r].prio {
+		x := s.merge(s.nodes[l].right, r)
+
+		s.nodes[l].right = x
+		s.fix(l)
+
+		return l
+	}
+
+	x := s.merge(l, s.nodes[r].left)
+
+	s.nodes[r].left = x
+	s.fix(r)
+
+	return r
+}
+
+func (s *OSTree) fix(t int32) {
+	n := &s.nodes[t]
+
+	n.size = s.nodes[n.left].size + s.nodes[n.right].size + 1
+}
+
+// NewMovingMedian creates the median filter over window last values.
+func NewMovingMedian(window int) *MovingMedian {
+	if window <= 0 {
+		panic(window)
+	}
+
+	return &MovingMedian{
+		ring: make([]float64, 0, window),
+	}
+}
+
+// Push adds v evicting the oldest value if the window is full
+// and returns the current median.
+// NaN values are ignored.
+func (m *MovingMedian) Push(v float64) float64 {
+	if math.IsNaN(v) {
+		return m.Median()
+	}
+
+	if len(m.ring) < cap(m.ring) {
+		m.ring = append(m.ring, v)
+	} else {
+		m.t.Remove(m.ring[m.i])
+		m.ring[m.i] = v
+		m.i = (m.i + 1) % len(m.ring)
+	}
+
+	m.t.Insert(v)
+
+	return m.Median()
+}
+
+// Median returns the median of the window values.
+// It's the mean of the two middle values for even number of values.
+func (m *MovingMedian) Median() float64 {
+	n := int(m.t.Count())
+	if n == 0 {
+		return 0
+	}
+
+	if n%2 == 1 {
+		return m.t.Select(n / 2)
+	}
+
+	return (m.t.Select(n/2-1) + m.t.Select(n/2)) / 2
+}
+
+// Reset clears the window.
+func (m *MovingMedian) Reset() {
+	m.t.Reset()
+	m.ring = m.ring[:0]
+	m.i = 0
+}
@@ -0,0 +1,121 @@
+package quantile
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestOSTree(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	s := NewOSTree()
+
+	var ref []float64
+
+	for i := range 5000 {
+		v := float64(r.IntN(100))
+
+		if r.IntN(3) == 0 {
+			found := s.Remove(v)
+
+			j, ok := slices.BinarySearch(ref, v)
+			if ok {
+				ref = slices.Delete(ref, j, j+1)
+			}
+
+			if found != ok {
+				tb.Fatalf("op %d: remove %v => %v  wanted %v", i, v, found, ok)
+			}
+		} else {
+			s.Insert(v)
+
+			j, _ := slices.BinarySearch(ref, v)
+			ref = slices.Insert(ref, j, v)
+		}
+
+		if s.Count() != float64(len(ref)) {
+			tb.Fatalf("op %d: count %v  wanted %v", i, s.Count(), len(ref))
+		}
+
+		if i%100 != 0 || len(ref) == 0 {
+			continue
+		}
+
+		for k := range ref {
+			if x := s.Select(k); x != ref[k] {
+				tb.Fatalf("op %d: select %d => %v  wanted %v", i, k, x, ref[k])
+			}
+		}
+
+		for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+			if x, y := s.Query(q), ref[min(int(q*float64(len(ref))), len(ref)-1)]; x != y {
+				tb.Errorf("op %d: q %.2f => %v  wanted %v", i, q, x, y)
+			}
+		}
+
+		for _, v := range []float64{-1, 0, 10.5, 50, 99, 100} {
+			j, _ := slices.BinarySearch(ref, v+0.5)
+
+			if x := s.Rank(v); x != float64(j) {
+				tb.Errorf("op %d: rank(%v) => %v  wanted %v", i, v, x, j)
+			}
+		}
+	}
+
+	s.Reset()
+
+	if s.Count() != 0 || s.Query(0.5) != 0 || s.Remove(1) {
+		tb.Errorf("not empty after reset")
+	}
+}
+
+func TestMovingMedian(tb *testing.T) {
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	for _, w := range []int{1, 2, 5, 16} {
+		m := NewMovingMedian(w)
+
+		var vals []float64
+
+		for i := range 200 {
+			v := float64(r.IntN(20))
+			vals = append(vals, v)
+
+			win := slices.Clone(vals[max(0, len(vals)-w):])
+			slices.Sort(win)
+
+			exp := win[len(win)/2]
+			if len(win)%2 == 0 {
+				exp = (win[len(win)/2-1] + exp) / 2
+			}
+
+			if x := m.Push(v); x != exp {
+				tb.Errorf("window %d: push %d => %v  wanted %v", w, i, x, exp)
+			}
+		}
+	}
+}
+
+func BenchmarkMovingMedian(tb *testing.B) {
+	tb.ReportAllocs()
+
+	src := rand.NewChaCha8([32]byte{})
+	r := rand.New(src)
+
+	m := NewMovingMedian(1000)
+
+	vs := make([]float64, tb.N)
+
+	for i := range vs {
+		vs[i] = r.NormFloat64()
+	}
+
+	tb.ResetTimer()
+
+	for i := 0; i < tb.N; i++ {
+		_ = m.Push(vs[i])
+	}
+}
@@ -0,0 +1,110 @@
+package quantile
+
+import (
+	"encoding"
+	"errors"
+)
+
+type (
+	// Sketch is a quantile estimator.
+	// All the sketches in the package implement it.
+	Sketch interface {
+		// Insert adds v. NaN is ignored.
+		Insert(v float64)
+
+		// InsertWeighted adds v with weight w.
+		// Sketches keeping values one by one (KLL, OSTree and ExternalExact)
+		// insert v w times, they ignore w if it's not a whole number up to MaxRepeats.
+		InsertWeighted(v float64, w float32)
+
+		Query(q float64) float64
+		QueryMulti(qs, res []float64)
+
+		// Rank returns the estimated total weight of values less than or equal to v.
+		Rank(v float64) float64
+
+		// Count returns the total weight of inserted values.
+		Count() float64
+
+		Reset()
+	}
+
+	// Merger is a Sketch which can merge in another one of the same type.
+	Merger interface {
+		Sketch
+
+		// MergeSketch adds s1 data to the sketch.
+		// ErrTypeMismatch is returned if s1 is of a different type.
+		MergeSketch(s1 Sketch) error
+	}
+
+	// Marshaler is a Sketch which can be serialized.
+	Marshaler interface {
+		Sketch
+
+		encoding.BinaryMarshaler
+		encoding.BinaryUnmarshaler
+	}
+)
+
+// MaxRepeats is the highest weight accepted by sketches inserting weighted values one by one.
+const MaxRepeats = 1 << 20
+
+var ErrTypeMismatch = errors.New("sketch type mismatch")
+
+var (
+	_ Sketch = (*TDigest)(nil)
+	_ Sketch = (*DDLog)(nil)
+	_ Sketch = (*KLL)(nil)
+	_ Sketch = (*Exact)(nil)
+	_ Sketch = (*ExternalExact)(nil)
+	_ Sketch = (*OSTree)(nil)
+
+	_ Merger = (*TDigest)(nil)
+	_ Merger = (*DDLog)(nil)
+	_ Merger = (*Exact)(nil)
+)
+
+// MergeSketch implements Merger.
+func (s *TDigest) MergeSketch(s1 Sketch) error {
+	x, ok := s1.(*TDigest)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	s.Merge(x)
+
+	return nil
+}
+
+// MergeSketch implements Merger.
+func (s *DDLog) MergeSketch(s1 Sketch) error {
+	x, ok := s1.(*DDLog)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	return s.Merge(x)
+}
+
+// MergeSketch implements Merger.
+func (s *Exact) MergeSketch(s1 Sketch) error {
+	x, ok := s1.(*Exact)
+	if !ok {
+		return ErrTypeMismatch
+	}
+
+	s.Merge(x)
+
+	return nil
+}
+
+// repeats returns how many times v is inserted with w weight
+// by sketches keeping values one by one.
+func repeats(w float32) int {
+	if !(w >= 0 && w <= MaxRepeats) || w != float32(int(w)) {
+		return 0
+	}
+
+	return int(w)
+}
@@ -0,0 +1,195 @@
+package quantile
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"testing"
+)
+
+func TestSketch(tb *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func(tb *testing.T) Sketch
+		eps  float64 // rank error
+		rel  float64 // relative value error
+		mono bool    // Query is monotonic
+		inf  bool    // infinities are kept
+	}{
+		{"TDigest", func(*testing.T) Sketch { return NewTDExtremesBiased(0.01, 512) }, 0.01, 0, true, true},
+		{"DDLog", func(*testing.T) Sketch { return NewDDLog(0.01) }, 0, 0.01, true, false},
+		{"DDLogSparse", func(*testing.T) Sketch { return NewDDLogStore(0.01, DDSparse|DDUint64) }, 0, 0.01, true, false},
+		{"KLL", func(*testing.T) Sketch { return NewKLL(128, 16) }, 0.03, 0, false, true},
+		{"Exact", func(*testing.T) Sketch { return NewExact() }, 0, 0, true, true},
+		{"OSTree", func(*testing.T) Sketch { return NewOSTree() }, 0, 0, true, true},
+		{"ExternalExact", func(tb *testing.T) Sketch {
+			s := NewExternalExact(tb.TempDir(), 8<<10)
+			tb.Cleanup(func() { _ = s.Close() })
+
+			return s
+		}, 0, 0, true, true},
+	} {
+		tb.Run(tc.name, func(tb *testing.T) {
+			testSketch(tb, tc.new(tb), tc.eps, tc.rel, tc.mono, tc.inf)
+		})
+	}
+}
+
+// testSketch checks s against the Sketch contract.
+// Queries and ranks must be within eps rank error
+// of the values within rel relative error of the exact ones.
+// Values are positive.
+func testSketch(tb *testing.T, s Sketch, eps, rel float64, mono, inf bool) {
+	const N = 10000
+
+	if c := s.Count(); c != 0 {
+		tb.Errorf("empty count: %v", c)
+	}
+	if r := s.Rank(1); r != 0 {
+		tb.Errorf("empty rank: %v", r)
+	}
+
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+	e := NewExact()
+
+	for range N {
+		v := 100 + 10*r.NormFloat64()
+
+		s.Insert(v)
+		e.Insert(v)
+	}
+
+	if c := s.Count(); c != N {
+		tb.Errorf("count: %v, want %v", c, N)
+	}
+
+	qs := []float64{0.9, 0.1, 0.5, 0, 0.5, 1, 0.99, 0.01}
+	res := make([]float64, len(qs))
+
+	s.QueryMulti(qs, res)
+
+	for i, q := range qs {
+		if v := s.Query(q); v != res[i] {
+			tb.Errorf("query multi %v: %v, query %v", q, res[i], v)
+		}
+	}
+
+	prev := math.Inf(-1)
+
+	for q := 0.0; q <= 1; q += 0.01 {
+		v := s.Query(q)
+		if mono && v < prev {
+			tb.Errorf("query %.2f: %v < %v", q, v, prev)
+		}
+
+		lo := e.Query(q-eps-2./N) / (1 + rel)
+		hi := e.Query(q+eps+2./N) * (1 + rel)
+
+		if v < lo || v > hi {
+			tb.Errorf("query %.2f: %v, want [%v %v]", q, v, lo, hi)
+		}
+
+		prev = v
+	}
+
+	vs := append([]float64{}, e.v...)
+	sort.Float64s(vs)
+
+	prev = 0
+
+	for i := 0; i < N; i += N / 100 {
+		v := vs[i]
+		rank := s.Rank(v)
+
+		if rank < prev {
+			tb.Errorf("rank %v: %v < %v", v, rank, prev)
+		}
+
+		// the whole bin is counted, it's up to 2*rel wide
+
+		lo := e.Rank(v/(1+2*rel)) - (eps*N + 1)
+		hi := e.Rank(v*(1+2*rel)) + (eps*N + 1)
+
+		if rank < lo || rank > hi {
+			tb.Errorf("rank %v: %v, want [%v %v]", v, rank, lo, hi)
+		}
+
+		prev = rank
+	}
+
+	if rank := s.Rank(vs[N-1]); rank != N {
+		tb.Errorf("rank max: %v, want %v", rank, N)
+	}
+
+	s.InsertWeighted(100, 3)
+
+	if c := s.Count(); c != N+3 {
+		tb.Errorf("weighted count: %v, want %v", c, N+3)
+	}
+
+	s.Insert(math.NaN())
+	s.InsertWeighted(math.NaN(), 2)
+
+	if c := s.Count(); c != N+3 {
+		tb.Errorf("nan count: %v, want %v", c, N+3)
+	}
+
+	s.Insert(math.Inf(1))
+	s.Insert(math.Inf(-1))
+
+	want := float64(N + 3)
+	if inf {
+		want += 2
+	}
+
+	if c := s.Count(); c != want {
+		tb.Errorf("inf count: %v, want %v", c, want)
+	}
+
+	if m, ok := s.(Merger); ok {
+		err := m.MergeSketch(NewOSTree())
+		if !errors.Is(err, ErrTypeMismatch) {
+			tb.Errorf("merge other type: %v", err)
+		}
+	}
+
+	s.Reset()
+
+	if c := s.Count(); c != 0 {
+		tb.Errorf("reset count: %v", c)
+	}
+
+	s.Insert(5)
+
+	if c, v := s.Count(), s.Query(0.5); c != 1 || v != 5 {
+		tb.Errorf("after reset: count %v, query %v", c, v)
+	}
+}
+
+func TestSketchRepeats(tb *testing.T) {
+	for name, s := range map[string]Sketch{
+		"KLL":           NewKLL(128, 16),
+		"OSTree":        NewOSTree(),
+		"ExternalExact": NewExternalExact(tb.TempDir(), 8<<10),
+	} {
+		for _, w := range []float32{0.5, 2.5, -1, float32(math.NaN()), float32(math.Inf(1)), 1e30, MaxRepeats + 1} {
+			s.InsertWeighted(1, w)
+		}
+
+		if c := s.Count(); c != 0 {
+			tb.Errorf("%v: count %v after invalid weights", name, c)
+		}
+
+		s.InsertWeighted(1, 3)
+
+		if c := s.Count(); c != 3 {
+			tb.Errorf("%v: count %v, want 3", name, c)
+		}
+
+		if c, ok := s.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
@@ -5,8 +5,10 @@ package quantile
 // https://github.com/ClickHouse/ClickHouse/blob/master/src/AggregateFunctions/QuantileTDigest.h
 
 import (
+	"cmp"
 	"fmt"
 	"math"
+	"slices"
 	"sort"
 	"strings"
 )
@@ -115,8 +117,15 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 		s.sort()
 	}
 
-	copy(res, qs)
-	sort.Float64s(res[:len(qs)])
+	var buf [8]int
+
+	idx := buf[:0]
+
+	for i := range qs {
+		idx = append(idx, i)
+	}
+
+	slices.SortFunc(idx, func(a, b int) int { return cmp.Compare(qs[a], qs[b]) })
 
 	var total, sum, prev float64
 
@@ -126,13 +135,8 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 
 	qi := 0
 
-	for qi < len(qs) && res[qi] <= 0 {
-		res[qi] = s.v[0]
-		qi++
-	}
-
-	for qi < len(qs) && res[qi] >= 1 {
-		res[qi] = s.v[s.i-1]
+	for qi < len(qs) && qs[idx[qi]] <= 0 {
+		res[idx[qi]] = s.v[0]
 		qi++
 	}
 
@@ -140,13 +144,13 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 		return
 	}
 
-	target := res[qi] * total
+	target := qs[idx[qi]] * total
 	prevV := s.v[0]
 
-	for i := 0; i < s.i; {
+	for i := 0; i < s.i && qs[idx[qi]] < 1; {
 		cur := sum + 0.5*float64(s.w[i])
 
-		//	log.Printf("query %.2f  i %2d  cur %.3f / %.3f  v %.2f  w %.1f", res[qi], i, cur, target, s.v[i], s.w[i])
+		//	log.Printf("query %.2f  i %2d  cur %.3f / %.3f  v %.2f  w %.1f", qs[idx[qi]], i, cur, target, s.v[i], s.w[i])
 
 		if cur >= target {
 			l := prev
@@ -154,11 +158,11 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 
 			switch {
 			case target <= l:
-				res[qi] = prevV
+				res[idx[qi]] = prevV
 			case target >= r:
-				res[qi] = s.v[i]
+				res[idx[qi]] = s.v[i]
 			default:
-				res[qi] = s.interpolate(target, l, r, prevV, s.v[i])
+				res[idx[qi]] = s.interpolate(target, l, r, prevV, s.v[i])
 			}
 
 			qi++
@@ -167,7 +171,7 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 				break
 			}
 
-			target = res[qi] * total
+			target = qs[idx[qi]] * total
 
 			continue
 		}
@@ -181,12 +185,59 @@ func (s *TDigest) QueryMulti(qs, res []float64) {
 	}
 
 	for qi < len(qs) {
-		res[qi] = s.v[s.i-1]
+		res[idx[qi]] = s.v[s.i-1]
 		qi++
 	}
 }
 
+// Rank returns the estimated total weight of values less than or equal to v.
+// Centroid weight is spread around its mean, so it's interpolated
+// between the neighbouring centroids the same way Query does.
+func (s *TDigest) Rank(v float64) float64 {
+	if s.i == 0 || math.IsNaN(v) {
+		return 0
+	}
+
+	if !s.sorted {
+		s.sort()
+	}
+
+	var sum, prev float64
+
+	for i := 0; i < s.i; i++ {
+		cur := sum + 0.5*float64(s.w[i])
+
+		if v < s.v[i] {
+			if i == 0 {
+				return 0
+			}
+
+			return s.interpolate(v, s.v[i-1], s.v[i], prev, cur)
+		}
+
+		sum += float64(s.w[i])
+		prev = cur
+	}
+
+	return sum
+}
+
+// Count returns the total weight of inserted values.
+func (s *TDigest) Count() float64 {
+	var sum float64
+
+	for _, w := range s.w[:s.i] {
+		sum += float64(w)
+	}
+
+	return sum
+}
+
 func (s *TDigest) interpolate(x, x1, x2 float64, y1, y2 float64) float64 {
+	return tdinterpolate(x, x1, x2, y1, y2)
+}
+
+func tdinterpolate(x, x1, x2 float64, y1, y2 float64) float64 {
 	k := float64(x-x1) / float64(x2-x1)
 
 	return y1*(1-k) + y2*k
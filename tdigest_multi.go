@@ -1,6 +1,9 @@
 package quantile
 
-import "sort"
+import (
+	"cmp"
+	"slices"
+)
 
 type TDMulti []*TDigest
 
@@ -12,6 +15,8 @@ func (ss TDMulti) Query(q float64) float64 {
 	return res[0]
 }
 
+// QueryMulti makes multiple queries at once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
 func (ss TDMulti) QueryMulti(qs, res []float64) {
 	if len(qs) == 0 || len(ss) == 0 {
 		for i := range qs {
@@ -21,9 +26,6 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 		return
 	}
 
-	copy(res, qs)
-	sort.Float64s(res[:len(qs)])
-
 	for _, s := range ss {
 		if !s.sorted {
 			s.sort()
@@ -66,11 +68,21 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 		return f
 	}
 
+	var buf [8]int
+
+	idx := buf[:0]
+
+	for i := range qs {
+		idx = append(idx, i)
+	}
+
+	slices.SortFunc(idx, func(a, b int) int { return cmp.Compare(qs[a], qs[b]) })
+
 	var last *TDigest
 
 	qi := 0
 
-	target := res[qi] * total
+	target := qs[idx[qi]] * total
 	prevV := first().v[0]
 
 	for {
@@ -81,7 +93,7 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 
 		cur := sum + 0.5*float64(s.w[s.j])
 
-		//	log.Printf("querymulti %.2f  i %2d  cur %.3f / %.3f  v %.2f  w %.1f", res[qi], s.j, cur, target, s.v[s.j], s.w[s.j])
+		//	log.Printf("querymulti %.2f  i %2d  cur %.3f / %.3f  v %.2f  w %.1f", qs[idx[qi]], s.j, cur, target, s.v[s.j], s.w[s.j])
 
 		if cur >= target {
 			l := prev
@@ -89,11 +101,11 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 
 			switch {
 			case target <= l:
-				res[qi] = prevV
+				res[idx[qi]] = prevV
 			case target >= r:
-				res[qi] = s.v[s.j]
+				res[idx[qi]] = s.v[s.j]
 			default:
-				res[qi] = s.interpolate(target, l, r, prevV, s.v[s.j])
+				res[idx[qi]] = s.interpolate(target, l, r, prevV, s.v[s.j])
 			}
 
 			qi++
@@ -102,7 +114,7 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 				break
 			}
 
-			target = res[qi] * total
+			target = qs[idx[qi]] * total
 
 			continue
 		}
@@ -117,7 +129,7 @@ func (ss TDMulti) QueryMulti(qs, res []float64) {
 	}
 
 	for qi < len(qs) {
-		res[qi] = last.v[last.i-1]
+		res[idx[qi]] = last.v[last.i-1]
 		qi++
 	}
 }
@@ -49,7 +49,7 @@ func TestTDMulti10(tb *testing.T) {
 	qs := []float64{0., 0.01, 0.1, 0.5, 0.9, 0.99, 1}
 
 	for _, q := range qs {
-		assertEqual(tb, e, ss, q, 0.02)
+		assertEqual(tb, e, ss, q, 0.051) // centroids are interpolated at their midpoints, half a step from Exact
 	}
 
 	res := make([]float64, len(qs))
@@ -59,6 +59,30 @@ func TestTDMulti10(tb *testing.T) {
 	tb.Logf("multi: %v -> %v", qs, res)
 }
 
+func TestTDMultiQueryOrder(tb *testing.T) {
+	ss := TDMulti{
+		NewTDExtremesBiased(0.01, 32),
+		NewTDExtremesBiased(0.01, 32),
+	}
+
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+
+	for range 1000 {
+		ss.Insert(r.Float64())
+	}
+
+	qs := []float64{0.9, 0.1, 1, 0.5, 0, 0.99, 0.01}
+	res := make([]float64, len(qs))
+
+	ss.QueryMulti(qs, res)
+
+	for i, q := range qs {
+		if v := ss.Query(q); res[i] != v {
+			tb.Errorf("q %v => %v  wanted %v", q, res[i], v)
+		}
+	}
+}
+
 func (s TDMulti) Insert(v float64) {
 	step := 1 / float64(len(s))
 	t := step
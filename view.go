@@ -0,0 +1,521 @@
+package quantile
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+type (
+	// TDigestView answers queries directly from TDigest binary encoding
+	// without decoding it.
+	// The data must not be modified while the view is used.
+	TDigestView struct {
+		v []byte // means
+		w []byte // weights
+		n int
+
+		total float64
+	}
+
+	// DDLogView answers queries directly from DDLog binary encoding
+	// without decoding the bins.
+	// The data must not be modified while the view is used.
+	// The view refers to itself, so it must not be copied after Load,
+	// use it by pointer.
+	DDLogView struct {
+		_ noCopy
+
+		s DDLog
+
+		pos, neg ddview
+	}
+
+	// ddview is a read-only store over the encoded bins.
+	ddview struct {
+		p   []byte // dense counts or sparse key/count pairs
+		st  DDStore
+		off int // dense: the first count key
+		n   int // the number of counts or pairs
+
+		lo, hi int // non-empty bins bounds
+		ok     bool
+
+		total float64
+
+		ckey      int
+		collapsed bool
+	}
+
+	// noCopy makes go vet copylocks check report copies of the containing struct.
+	noCopy struct{}
+)
+
+var ErrCompactView = errors.New("compact encoding can't be viewed")
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
+// NewTDigestView creates a view over TDigest encoded by MarshalBinary.
+func NewTDigestView(p []byte) (*TDigestView, error) {
+	v := &TDigestView{}
+
+	err := v.Load(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Load makes v a view over p, so one view can be reused for many sketches.
+// The data is checked and weights are summed up, it doesn't allocate.
+func (v *TDigestView) Load(p []byte) error {
+	r, err := binOpen(p, binTDigest)
+	if err != nil {
+		return err
+	}
+
+	if r.compact {
+		return ErrCompactView
+	}
+
+	_ = r.byte()
+	_ = r.float32()
+	_ = r.float32()
+	size := r.len(binMaxAlloc)
+	n := r.len(size)
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if r.left() != n*12 {
+		return ErrMalformed
+	}
+
+	x := TDigestView{
+		v: r.b[r.i : r.i+n*8],
+		w: r.b[r.i+n*8:],
+		n: n,
+	}
+
+	for i := range n {
+		m := x.mean(i)
+
+		if math.IsNaN(m) || i != 0 && m < x.mean(i-1) || !(x.weight(i) >= 0) {
+			return ErrMalformed
+		}
+
+		x.total += float64(x.weight(i))
+	}
+
+	*v = x
+
+	return nil
+}
+
+func (v *TDigestView) Query(q float64) float64 {
+	var buf [1]float64
+
+	v.QueryMulti([]float64{q}, buf[:])
+
+	return buf[0]
+}
+
+// QueryMulti makes multiple queries at once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+// The results are the same as TDigest gives.
+func (v *TDigestView) QueryMulti(qs, res []float64) {
+	if v.n == 0 || len(qs) == 0 {
+		clear(res[:len(qs)])
+		return
+	}
+	if v.n == 1 {
+		for i := range qs {
+			res[i] = v.mean(0)
+		}
+
+		return
+	}
+
+	var buf [8]int
+
+	idx := buf[:0]
+
+	for i := range qs {
+		idx = append(idx, i)
+	}
+
+	slices.SortFunc(idx, func(a, b int) int { return cmp.Compare(qs[a], qs[b]) })
+
+	var sum, prev float64
+
+	qi := 0
+
+	for qi < len(qs) && qs[idx[qi]] <= 0 {
+		res[idx[qi]] = v.mean(0)
+		qi++
+	}
+
+	if qi == len(qs) {
+		return
+	}
+
+	target := qs[idx[qi]] * v.total
+	prevV := v.mean(0)
+
+	for i := 0; i < v.n && qs[idx[qi]] < 1; {
+		m, w := v.mean(i), float64(v.weight(i))
+		cur := sum + 0.5*w
+
+		if cur >= target {
+			switch {
+			case target <= prev:
+				res[idx[qi]] = prevV
+			case target >= cur:
+				res[idx[qi]] = m
+			default:
+				res[idx[qi]] = tdinterpolate(target, prev, cur, prevV, m)
+			}
+
+			qi++
+
+			if qi == len(qs) {
+				break
+			}
+
+			target = qs[idx[qi]] * v.total
+
+			continue
+		}
+
+		sum += w
+
+		prev = cur
+		prevV = m
+
+		i++
+	}
+
+	for qi < len(qs) {
+		res[idx[qi]] = v.mean(v.n - 1)
+		qi++
+	}
+}
+
+// Rank returns the estimated total weight of values less than or equal to x
+// the same way as TDigest does.
+func (v *TDigestView) Rank(x float64) float64 {
+	if v.n == 0 || math.IsNaN(x) {
+		return 0
+	}
+
+	var sum, prev float64
+
+	for i := range v.n {
+		w := float64(v.weight(i))
+		cur := sum + 0.5*w
+
+		if x < v.mean(i) {
+			if i == 0 {
+				return 0
+			}
+
+			return tdinterpolate(x, v.mean(i-1), v.mean(i), prev, cur)
+		}
+
+		sum += w
+		prev = cur
+	}
+
+	return sum
+}
+
+// Count returns the total weight of centroids.
+func (v *TDigestView) Count() float64 {
+	return v.total
+}
+
+func (v *TDigestView) mean(i int) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(v.v[8*i:]))
+}
+
+func (v *TDigestView) weight(i int) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(v.w[4*i:]))
+}
+
+// NewDDLogView creates a view over DDLog encoded by MarshalBinary.
+func NewDDLogView(p []byte) (*DDLogView, error) {
+	v := &DDLogView{}
+
+	err := v.Load(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Load makes v a view over p, so one view can be reused for many sketches.
+// The data is checked and bins are summed up,
+// it doesn't allocate unless the index mapping differs from the previous one.
+func (v *DDLogView) Load(p []byte) error {
+	r, err := binOpen(p, binDDLog)
+	if err != nil {
+		return err
+	}
+
+	if r.compact {
+		return ErrCompactView
+	}
+
+	interp := r.byte()
+	gamma := r.float64()
+	offset := r.float64()
+	kind := DDStore(r.byte())
+	_ = r.len(math.MaxInt32) // MaxBins
+	_ = r.byte()             // Collapse
+
+	zeros := r.float64()
+	vmin := r.float64()
+	vmax := r.float64()
+	sum := r.float64()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if !binIsCount(zeros) || math.IsNaN(vmin) || math.IsNaN(vmax) || math.IsNaN(sum) {
+		return ErrMalformed
+	}
+
+	if kind&ddKindMask > DDSparse || kind&ddCountsMask > DDUint64 || kind&^(ddKindMask|ddCountsMask) != 0 {
+		return ErrMalformed
+	}
+
+	m := v.s.m
+
+	if g, o, i, err := ddMappingParams(m); err != nil || g != gamma || o != offset || i != int(interp) {
+		m, err = ddMapping(gamma, offset, uint64(interp))
+		if err != nil {
+			return err
+		}
+	}
+
+	var pos, neg ddview
+
+	err = pos.parse(&r, kind)
+	if err != nil {
+		return err
+	}
+
+	err = neg.parse(&r, kind)
+	if err != nil {
+		return err
+	}
+
+	err = r.finish()
+	if err != nil {
+		return err
+	}
+
+	v.pos, v.neg = pos, neg
+
+	v.s = DDLog{
+		pos: &v.pos,
+		neg: &v.neg,
+
+		zeros:   zeros,
+		integer: kind&ddCountsMask == DDUint64,
+
+		min: vmin,
+		max: vmax,
+		sum: sum,
+
+		m:           m,
+		minPossible: m.MinIndexable(),
+		maxPossible: m.MaxIndexable(),
+	}
+
+	return nil
+}
+
+// Query returns q quantile estimate the same way as DDLog does.
+func (v *DDLogView) Query(q float64) float64 { return v.s.Query(q) }
+
+// QueryMulti makes multiple queries at once walking the bins once.
+// res[i] is set to Query(qs[i]), res must be at least len(qs) long.
+func (v *DDLogView) QueryMulti(qs, res []float64) { v.s.QueryMulti(qs, res) }
+
+// Rank returns the estimated total weight of values less than or equal to x.
+func (v *DDLogView) Rank(x float64) float64 { return v.s.Rank(x) }
+
+// CDF returns the estimated fraction of values less than or equal to x.
+func (v *DDLogView) CDF(x float64) float64 { return v.s.CDF(x) }
+
+func (v *DDLogView) Count() float64 { return v.s.Count() }
+func (v *DDLogView) Sum() float64   { return v.s.Sum() }
+func (v *DDLogView) Min() float64   { return v.s.Min() }
+func (v *DDLogView) Max() float64   { return v.s.Max() }
+
+// parse reads store encoded by binAppendStore checking it and computing the sum and the bounds.
+func (b *ddview) parse(r *binReader, kind DDStore) error {
+	*b = ddview{st: kind}
+
+	switch r.byte() {
+	case 0:
+	case 1:
+		b.ckey = r.int()
+		b.collapsed = true
+	default:
+		r.err = ErrMalformed
+	}
+
+	if b.sparse() {
+		b.n = r.len(r.left() / 9)
+	} else {
+		b.off = r.int()
+		b.n = r.len(r.left() / 8)
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	st := r.i
+	prev := math.MinInt
+
+	for i := range b.n {
+		key := b.off + i
+
+		if b.sparse() {
+			key = r.int()
+		}
+
+		w := r.float64()
+
+		if r.err == nil && (!binIsCount(w) || b.sparse() && (w == 0 || key <= prev)) {
+			r.err = ErrMalformed
+		}
+
+		if r.err != nil {
+			return r.err
+		}
+
+		prev = key
+
+		if w == 0 {
+			continue
+		}
+
+		if !b.ok {
+			b.lo, b.ok = key, true
+		}
+
+		b.hi = key
+		b.total += w
+	}
+
+	b.p = r.b[st:r.i]
+
+	return nil
+}
+
+// next returns the bin at p[i:] and the next bin position.
+func (b *ddview) next(i, k int) (key int, w float64, next int) {
+	if !b.sparse() {
+		return b.off + k, math.Float64frombits(binary.LittleEndian.Uint64(b.p[i:])), i + 8
+	}
+
+	x, n := binary.Varint(b.p[i:])
+	i += n
+
+	return int(x), math.Float64frombits(binary.LittleEndian.Uint64(b.p[i:])), i + 8
+}
+
+func (b *ddview) sparse() bool { return b.st&ddKindMask == DDSparse }
+
+func (b *ddview) sum() float64 { return b.total }
+
+func (b *ddview) bounds() (lo, hi int, ok bool) { return b.lo, b.hi, b.ok }
+
+func (b *ddview) find(limit float64, eq bool) int {
+	var cum float64
+	var key int
+	var w float64
+
+	for i, k := 0, 0; k < b.n; k++ {
+		key, w, i = b.next(i, k)
+
+		cum += w
+		if cum > limit || eq && cum == limit {
+			return key
+		}
+	}
+
+	return key
+}
+
+func (b *ddview) rank(key int) (below, w float64) {
+	for i, k := 0, 0; k < b.n; k++ {
+		var x float64
+		var bk int
+
+		bk, x, i = b.next(i, k)
+
+		switch {
+		case bk < key:
+			below += x
+		case bk == key:
+			return below, x
+		default:
+			return below, 0
+		}
+	}
+
+	return below, 0
+}
+
+func (b *ddview) each(f func(key int, w float64)) {
+	for i, k := 0, 0; k < b.n; k++ {
+		var key int
+		var w float64
+
+		key, w, i = b.next(i, k)
+
+		if w != 0 {
+			f(key, w)
+		}
+	}
+}
+
+// nextBin uses p offset as the position.
+func (b *ddview) nextBin(i int) (key int, w float64, next int, ok bool) {
+	for i < len(b.p) {
+		key, w, i = b.next(i, i/8)
+
+		if w != 0 {
+			return key, w, i, true
+		}
+	}
+
+	return 0, 0, i, false
+}
+
+func (b *ddview) collapsedKey() (int, bool) { return b.ckey, b.collapsed }
+
+func (b *ddview) kind() DDStore { return b.st }
+
+func (b *ddview) size() int { return 0 }
+
+func (b *ddview) add(key int, w float64, limit int) { panic("read-only") }
+func (b *ddview) sub(key int, w float64) float64    { panic("read-only") }
+func (b *ddview) reserve(lo, hi, limit int)         { panic("read-only") }
+func (b *ddview) adjust(multiply float64)           { panic("read-only") }
+func (b *ddview) reset(shrink int)                  { panic("read-only") }
+func (b *ddview) foldBelow(l int) bool              { panic("read-only") }
+func (b *ddview) foldAbove(h int) bool              { panic("read-only") }
+func (b *ddview) markCollapsed(key int)             { panic("read-only") }
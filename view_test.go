@@ -0,0 +1,187 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestTDigestView(tb *testing.T) {
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+	s := NewTDExtremesBiased(0.01, 128)
+
+	for range 10000 {
+		s.Insert(r.NormFloat64())
+	}
+
+	s.InsertWeighted(1, 0.5)
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	v, err := NewTDigestView(data)
+	if err != nil {
+		tb.Fatalf("view: %v", err)
+	}
+
+	testView(tb, s, v)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = v.Load(data)
+		_ = v.Query(0.5)
+		_ = v.Rank(0)
+	})
+	if allocs != 0 {
+		tb.Errorf("allocs: %v", allocs)
+	}
+
+	comp, err := s.MarshalCompact()
+	if err != nil {
+		tb.Fatalf("marshal compact: %v", err)
+	}
+
+	err = v.Load(comp)
+	if !errors.Is(err, ErrCompactView) {
+		tb.Errorf("compact: %v", err)
+	}
+
+	// the last weight goes right before the checksum
+	binary.LittleEndian.PutUint32(data[len(data)-8:], math.Float32bits(-1))
+	data = binary.LittleEndian.AppendUint32(data[:len(data)-4], crc32.Checksum(data[:len(data)-4], binCRC))
+
+	err = v.Load(data)
+	if !errors.Is(err, ErrMalformed) {
+		tb.Errorf("negative weight: %v", err)
+	}
+}
+
+func TestDDLogView(tb *testing.T) {
+	for _, st := range []DDStore{DDDense, DDDense | DDFloat64, DDDense | DDUint64, DDSparse, DDSparse | DDUint64} {
+		r := rand.New(rand.NewChaCha8([32]byte{}))
+		s := NewDDLogStore(0.01, st)
+		s.MaxBins = 100
+
+		for i := range 10000 {
+			v := r.ExpFloat64() * 100
+
+			switch i % 10 {
+			case 0:
+				v = -v
+			case 1:
+				v = 0
+			}
+
+			s.Insert(v)
+		}
+
+		data, err := s.MarshalBinary()
+		if err != nil {
+			tb.Fatalf("marshal: %v", err)
+		}
+
+		v, err := NewDDLogView(data)
+		if err != nil {
+			tb.Fatalf("view: %v", err)
+		}
+
+		testView(tb, s, v)
+
+		if v.Min() != s.Min() || v.Max() != s.Max() || v.Sum() != s.Sum() {
+			tb.Errorf("stats: %v %v %v, want %v %v %v", v.Min(), v.Max(), v.Sum(), s.Min(), s.Max(), s.Sum())
+		}
+
+		for _, x := range []float64{-100, 0, 10, 1000} {
+			if c, want := v.CDF(x), s.CDF(x); c != want {
+				tb.Errorf("cdf %v: %v, want %v", x, c, want)
+			}
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = v.Load(data)
+			_ = v.Query(0.5)
+			_ = v.Rank(0)
+		})
+		if allocs != 0 {
+			tb.Errorf("allocs: %v", allocs)
+		}
+	}
+}
+
+func testView(tb *testing.T, s, v interface {
+	Query(q float64) float64
+	QueryMulti(qs, res []float64)
+	Rank(v float64) float64
+	Count() float64
+},
+) {
+	tb.Helper()
+
+	if c, want := v.Count(), s.Count(); c != want {
+		tb.Errorf("count: %v, want %v", c, want)
+	}
+
+	qs := []float64{0.5, 0, 0.001, 0.01, 0.05, 0.1, 0.2, 0.5, 0.8, 0.9, 0.95, 0.99, 0.999, 1}
+
+	res := make([]float64, len(qs))
+	want := make([]float64, len(qs))
+
+	v.QueryMulti(qs, res)
+	s.QueryMulti(qs, want)
+
+	for i, q := range qs {
+		if x, w := v.Query(q), s.Query(q); x != w {
+			tb.Errorf("query %v: %v, want %v", q, x, w)
+		}
+
+		if res[i] != want[i] {
+			tb.Errorf("query multi %v: %v, want %v", q, res[i], want[i])
+		}
+	}
+
+	for _, x := range []float64{-1000, -1, 0, 0.5, 1, 10, 100, 1000} {
+		if r, w := v.Rank(x), s.Rank(x); r != w {
+			tb.Errorf("rank %v: %v, want %v", x, r, w)
+		}
+	}
+}
+
+func BenchmarkDDLogView(tb *testing.B) {
+	r := rand.New(rand.NewChaCha8([32]byte{}))
+	s := NewDDLog(0.01)
+
+	for range 100000 {
+		s.Insert(r.ExpFloat64())
+	}
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("marshal: %v", err)
+	}
+
+	tb.Run("View", func(tb *testing.B) {
+		tb.ReportAllocs()
+
+		var v DDLogView
+
+		for i := 0; i < tb.N; i++ {
+			_ = v.Load(data)
+			_ = v.Query(0.99)
+		}
+	})
+
+	tb.Run("Unmarshal", func(tb *testing.B) {
+		tb.ReportAllocs()
+
+		var s DDLog
+
+		for i := 0; i < tb.N; i++ {
+			_ = s.UnmarshalBinary(data)
+			_ = s.Query(0.99)
+		}
+	})
+}